@@ -2,9 +2,8 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"os"
-
-	"github.com/BurntSushi/toml"
 )
 
 type LoggerConfig struct {
@@ -12,33 +11,107 @@ type LoggerConfig struct {
 	Style   string
 }
 
+// ReadyConfig configures a readiness probe for the program. Only one of HTTP (a URL to GET),
+// TCP (an address to connect to) and LogLine (a regex matched against the program's output)
+// can be set. Timeout and Interval are in milliseconds.
+type ReadyConfig struct {
+	HTTP     string
+	TCP      string
+	LogLine  string
+	Timeout  int
+	Interval int
+}
+
 type ProgConfig struct {
-	Name string
-	Args []string
+	Name           string
+	Args           []string
+	StopSignal     string
+	StopTimeout    int
+	Ready          ReadyConfig `toml:",omitempty"`
+	Restart        string
+	MaxRestarts    int
+	RestartBackoff int
+	Stdin          string `toml:",omitempty"`
+}
+
+// BuildStep is one command in a build pipeline. Env entries are on the form KEY=value and are
+// added to kjor's environment.
+type BuildStep struct {
+	Name            string
+	Command         string
+	Args            []string
+	Env             []string
+	Dir             string
+	ContinueOnError bool
 }
 
-type ProcessConfig struct {
-	Program ProgConfig
-	Build   ProgConfig
+// BuildConfig describes the build. Either Name and Args are used as a single command, or Steps
+// are run in order. If any of the arguments contain the {{output}} placeholder, the build writes
+// to a temporary file which replaces Output only when the build succeeds. Output defaults to the
+// program name.
+type BuildConfig struct {
+	Name   string
+	Args   []string
+	Output string `toml:",omitempty"`
+	Steps  []BuildStep
 }
 
+// FileWatcherConfig configures how changes are found. Paths are the directories and files that
+// are watched, relative to the working directory or absolute, and WatchReplaces adds the local
+// replace targets of go.mod to them. Ignore holds regexes and IgnoreGlob
+// globs of paths relative to the watched directories that are not watched. When Include is set,
+// only files matching one of its globs are. PollInterval is the time in milliseconds between
+// scans with the poll backend. UseGitignore ignores what git ignores, in addition to what is in
+// .kjorignore files.
 type FileWatcherConfig struct {
-	Backend string
-	Ignore  []string
+	Backend       string
+	Paths         []string
+	WatchReplaces bool
+	Ignore        []string
+	IgnoreGlob    []string
+	Include       []string
+	UseGitignore  bool
+	Debounce      int
+	MaxWait       int
+	PollInterval  int
 }
 
+// RuleConfig maps changed files matching any of Glob or Regex to an action. Paths are matched
+// relative to the working directory. Command is run by the run-command action.
+type RuleConfig struct {
+	Glob    []string
+	Regex   []string
+	Action  string
+	Command []string
+}
+
+// SSEConfig configures the browser notifications. CSSRoutes maps directories, relative to the
+// working directory, to the URL they are served under, e.g. "web/static" = "/static".
 type SSEConfig struct {
 	Enable         bool
 	Port           int
 	RestartTimeout int
+	CSSRoutes      map[string]string
+}
+
+// ProxyConfig configures the reverse proxy in front of the program. Target is the URL of the
+// program, and Timeout is how long in milliseconds a request is held while the program is down.
+type ProxyConfig struct {
+	Enable  bool
+	Port    int
+	Target  string
+	Timeout int
 }
 
+// Config is the contents of kjor.toml. Version is the version of the layout, see Migrate.
 type Config struct {
-	Process     ProcessConfig
+	Version     int
 	Program     ProgConfig
-	Build       ProgConfig
+	Build       BuildConfig
 	Filewatcher FileWatcherConfig
+	Rules       []RuleConfig
 	SSE         SSEConfig
+	Proxy       ProxyConfig
 	Logger      LoggerConfig
 }
 
@@ -46,25 +119,43 @@ var ConfigNotFound = errors.New("Config file not found")
 
 func DefaultConfig() *Config {
 	return &Config{
-		Process: ProcessConfig{
-			Program: ProgConfig{
-				Name: "./a.out",
-				Args: []string{},
-			},
-			Build: ProgConfig{
-				Name: "go",
-				Args: []string{"build", "-o", "a.out", "./"},
-			},
+		Version: CurrentVersion,
+		Program: ProgConfig{
+			Name:           "./a.out",
+			Args:           []string{},
+			StopSignal:     "SIGTERM",
+			StopTimeout:    5000,
+			Restart:        "never",
+			MaxRestarts:    5,
+			RestartBackoff: 500,
+		},
+		Build: BuildConfig{
+			Name: "go",
+			Args: []string{"build", "-o", "{{output}}", "./"},
 		},
 		Filewatcher: FileWatcherConfig{
-			Backend: "inotify",
-			Ignore:  []string{"^\\.#", "^#", "~$", "_test\\.go$", "a\\.out$"},
+			Backend:       "inotify",
+			Paths:         []string{"."},
+			WatchReplaces: false,
+			Ignore:        []string{"^\\.#", "^#", "~$", "_test\\.go$", "a\\.out$", "\\.kjor-tmp"},
+			IgnoreGlob:    []string{},
+			Include:       []string{},
+			UseGitignore:  false,
+			Debounce:      200,
+			MaxWait:       2000,
+			PollInterval:  500,
 		},
 		SSE: SSEConfig{
 			Enable:         true,
 			Port:           8888,
 			RestartTimeout: 1000,
 		},
+		Proxy: ProxyConfig{
+			Enable:  false,
+			Port:    8000,
+			Target:  "http://localhost:8080",
+			Timeout: 10000,
+		},
 		Logger: LoggerConfig{
 			Verbose: false,
 			Style: "terminal",
@@ -73,22 +164,39 @@ func DefaultConfig() *Config {
 }
 
 func (c *Config) IsValid() bool {
-	return c.Program.Name != "" && c.Build.Name != ""
+	return len(c.Validate()) == 0
 }
 
-func ReadConfig() (*Config, error) {
-	configFile := "kjor.toml"
+// ConfigPath returns the config file given as the first argument, or kjor.toml.
+func ConfigPath() string {
 	if len(os.Args) > 1 {
-		configFile = os.Args[1]
+		return os.Args[1]
 	}
+	return "kjor.toml"
+}
 
-	if _, err := os.Stat(configFile); errors.Is(err, os.ErrNotExist) {
+func ReadConfig() (*Config, error) {
+	return ReadConfigFile(ConfigPath())
+}
+
+// ReadConfigFile reads and validates a config file. Files in an older layout are migrated in
+// memory. Unknown keys and invalid values are returned together as a *ValidationError.
+func ReadConfigFile(configFile string) (*Config, error) {
+	data, err := os.ReadFile(configFile)
+	if errors.Is(err, os.ErrNotExist) {
 		return nil, ConfigNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read config: [%v]", err)
+	}
+
+	config, md, err := decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse config %s: [%v]", configFile, err)
 	}
 
-	config := DefaultConfig()
-	if _, err := toml.DecodeFile(configFile, config); err != nil {
-		return nil, err
+	problems := append(unknownKeys(md, data), config.Validate()...)
+	if len(problems) > 0 {
+		return nil, &ValidationError{File: configFile, Problems: problems}
 	}
 	return config, nil
 }
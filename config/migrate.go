@@ -0,0 +1,111 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/BurntSushi/toml"
+)
+
+// CurrentVersion is the version of the config layout written by this version of kjor.
+//
+// Version 1 (files without a Version) could have the program and build both at the top level
+// and under [Process.Program] and [Process.Build]. Version 2 only has them at the top level.
+const CurrentVersion = 2
+
+// legacyConfig is the layout of version 1.
+type legacyConfig struct {
+	Config
+	Process struct {
+		Program ProgConfig
+		Build   BuildConfig
+	}
+}
+
+func ConfigTooNew(version int) error {
+	return fmt.Errorf("Config version %d is newer than this kjor supports (%d)", version, CurrentVersion)
+}
+
+// decode decodes a config of any version on top of the defaults, and migrates it to the current
+// version.
+func decode(data []byte) (*Config, toml.MetaData, error) {
+	var header struct{ Version int }
+	if _, err := toml.Decode(string(data), &header); err != nil {
+		return nil, toml.MetaData{}, err
+	}
+
+	switch {
+	case header.Version > CurrentVersion:
+		return nil, toml.MetaData{}, ConfigTooNew(header.Version)
+	case header.Version == CurrentVersion:
+		config := DefaultConfig()
+		md, err := toml.Decode(string(data), config)
+		return config, md, err
+	}
+
+	// [Process.Program] and [Process.Build] are decoded on top of the defaults too, and are used
+	// when the top level does not have the table, or has it without a Name. Version 1 wrote both,
+	// with the top level ones empty.
+	legacy := &legacyConfig{Config: *DefaultConfig()}
+	legacy.Process.Program = DefaultConfig().Program
+	legacy.Process.Build = DefaultConfig().Build
+	md, err := toml.Decode(string(data), legacy)
+	if err != nil {
+		return nil, md, err
+	}
+
+	config := &legacy.Config
+	if (!md.IsDefined("Program") || config.Program.Name == "") && md.IsDefined("Process", "Program") {
+		config.Program = legacy.Process.Program
+	}
+	emptyBuild := config.Build.Name == "" && len(config.Build.Steps) == 0
+	if (!md.IsDefined("Build") || emptyBuild) && md.IsDefined("Process", "Build") {
+		config.Build = legacy.Process.Build
+	}
+	config.Version = CurrentVersion
+	return config, md, nil
+}
+
+// Migrate rewrites a config file in the current layout, keeping the old file next to it with a
+// .bak suffix. It returns false if the file was already up to date. Comments are not kept. A file
+// that would not be valid after migrating is left alone, and its problems are returned as a
+// *ValidationError.
+func Migrate(configFile string) (bool, error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return false, fmt.Errorf("Failed to read config: [%v]", err)
+	}
+
+	var header struct{ Version int }
+	if _, err := toml.Decode(string(data), &header); err != nil {
+		return false, fmt.Errorf("Failed to parse config %s: [%v]", configFile, err)
+	}
+	if header.Version == CurrentVersion {
+		return false, nil
+	}
+
+	config, md, err := decode(data)
+	if err != nil {
+		return false, fmt.Errorf("Failed to parse config %s: [%v]", configFile, err)
+	}
+
+	// The file is only replaced by one that kjor can run.
+	problems := append(unknownKeys(md, data), config.Validate()...)
+	if len(problems) > 0 {
+		return false, &ValidationError{File: configFile, Problems: problems}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := toml.NewEncoder(buf).Encode(config); err != nil {
+		return false, fmt.Errorf("Failed to encode config: [%v]", err)
+	}
+
+	if err := os.WriteFile(configFile+".bak", data, 0644); err != nil {
+		return false, fmt.Errorf("Failed to back up config: [%v]", err)
+	}
+	if err := os.WriteFile(configFile, buf.Bytes(), 0644); err != nil {
+		return false, fmt.Errorf("Failed to write config: [%v]", err)
+	}
+	return true, nil
+}
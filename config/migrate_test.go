@@ -0,0 +1,193 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestDefaultConfigRoundTrip(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if err := toml.NewEncoder(buf).Encode(DefaultConfig()); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	config, md, err := decode(buf.Bytes())
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		t.Errorf("Keys were not decoded: %v", undecoded)
+	}
+	if want := DefaultConfig(); !reflect.DeepEqual(config, want) {
+		t.Errorf("Got\n%+v\nwant\n%+v", config, want)
+	}
+}
+
+const v1Config = `
+[Process.Program]
+Name = "./server"
+Args = ["-port", "8080"]
+
+[Process.Build]
+Name = "make"
+Args = ["server"]
+
+[Filewatcher]
+Debounce = 100
+`
+
+func TestMigrateV1(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "kjor.toml")
+	if err := os.WriteFile(file, []byte(v1Config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err := Migrate(file)
+	if err != nil || !migrated {
+		t.Fatalf("Migrate() = %t, %v", migrated, err)
+	}
+
+	backup, err := os.ReadFile(file + ".bak")
+	if err != nil || string(backup) != v1Config {
+		t.Errorf("The backup has %q, %v", backup, err)
+	}
+
+	config, err := ReadConfigFile(file)
+	if err != nil {
+		t.Fatalf("ReadConfigFile: %v", err)
+	}
+
+	want := DefaultConfig()
+	want.Program.Name = "./server"
+	want.Program.Args = []string{"-port", "8080"}
+	want.Build.Name = "make"
+	want.Build.Args = []string{"server"}
+	want.Filewatcher.Debounce = 100
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("Got\n%+v\nwant\n%+v", config, want)
+	}
+
+	// The defaults of the [Process] tables are kept, not zeroed.
+	if config.Program.StopSignal != "SIGTERM" || config.Program.StopTimeout != 5000 {
+		t.Errorf("Lost the program defaults: %+v", config.Program)
+	}
+
+	if migrated, err := Migrate(file); err != nil || migrated {
+		t.Errorf("Migrating again = %t, %v, want nothing to do", migrated, err)
+	}
+}
+
+func TestMigrateV1PrefersTopLevel(t *testing.T) {
+	config, _, err := decode([]byte(`
+[Program]
+Name = "./top"
+
+[Process.Program]
+Name = "./process"
+`))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if config.Program.Name != "./top" {
+		t.Errorf("Program.Name = %q, want ./top", config.Program.Name)
+	}
+	if config.Version != CurrentVersion {
+		t.Errorf("Version = %d, want %d", config.Version, CurrentVersion)
+	}
+	if !slices.Equal(config.Build.Args, DefaultConfig().Build.Args) {
+		t.Errorf("Build.Args = %v, want the default", config.Build.Args)
+	}
+}
+
+// baselineConfig is the kjor.toml written by versions that had [Process], with empty top level
+// tables next to it.
+const baselineConfig = `[Process]
+  [Process.Program]
+    Name = "./a.out"
+    Args = []
+  [Process.Build]
+    Name = "go"
+    Args = ["build", "-o", "a.out", "./"]
+
+[Program]
+  Name = ""
+
+[Build]
+  Name = ""
+
+[Filewatcher]
+  Backend = "inotify"
+  Ignore = ["^\\.#", "^#", "~$", "_test\\.go$", "a\\.out$"]
+
+[SSE]
+  Enable = true
+  Port = 8888
+  RestartTimeout = 1000
+
+[Logger]
+  Verbose = false
+  Style = "terminal"
+`
+
+func TestMigrateBaselineConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "kjor.toml")
+	if err := os.WriteFile(file, []byte(baselineConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := DefaultConfig()
+	want.Program.Name = "./a.out"
+	want.Build.Name = "go"
+	want.Build.Args = []string{"build", "-o", "a.out", "./"}
+	want.Filewatcher.Ignore = []string{"^\\.#", "^#", "~$", "_test\\.go$", "a\\.out$"}
+
+	// Read as it is, and after migrating.
+	config, err := ReadConfigFile(file)
+	if err != nil {
+		t.Fatalf("ReadConfigFile before migrating: %v", err)
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("Got\n%+v\nwant\n%+v", config, want)
+	}
+
+	if migrated, err := Migrate(file); err != nil || !migrated {
+		t.Fatalf("Migrate() = %t, %v", migrated, err)
+	}
+
+	config, err = ReadConfigFile(file)
+	if err != nil {
+		t.Fatalf("ReadConfigFile after migrating: %v", err)
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("Got\n%+v\nwant\n%+v", config, want)
+	}
+}
+
+func TestMigrateKeepsInvalidFile(t *testing.T) {
+	const invalid = "[Program]\n  Name = \"\"\n\n[SSE]\n  Port = 0\n"
+	file := filepath.Join(t.TempDir(), "kjor.toml")
+	if err := os.WriteFile(file, []byte(invalid), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err := Migrate(file)
+	var validationErr *ValidationError
+	if migrated || !errors.As(err, &validationErr) {
+		t.Fatalf("Migrate() = %t, %v, want a *ValidationError", migrated, err)
+	}
+
+	if data, _ := os.ReadFile(file); string(data) != invalid {
+		t.Errorf("The file was changed to:\n%s", data)
+	}
+	if _, err := os.Stat(file + ".bak"); err == nil {
+		t.Error("A backup was written")
+	}
+}
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/subfusc/kjor/file_watcher/common"
+)
+
+var (
+	Backends     = []string{"inotify", "fanotify", "poll"}
+	LoggerStyles = []string{"terminal", "plain"}
+)
+
+// ValidationError lists every problem found in a config file.
+type ValidationError struct {
+	File     string
+	Problems []error
+}
+
+func (ve *ValidationError) Error() string {
+	buf := strings.Builder{}
+	fmt.Fprintf(&buf, "Invalid config %s:", ve.File)
+	for _, problem := range ve.Problems {
+		buf.WriteString("\n  " + problem.Error())
+	}
+	return buf.String()
+}
+
+func (ve *ValidationError) Unwrap() []error {
+	return ve.Problems
+}
+
+func checkPort(name string, port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("%s: Port %d is not between 1 and 65535", name, port)
+	}
+	return nil
+}
+
+// Validate checks the values of the config, and returns every problem found.
+func (c *Config) Validate() []error {
+	problems := make([]error, 0)
+
+	if c.Program.Name == "" {
+		problems = append(problems, fmt.Errorf("Program.Name: Missing the program to run"))
+	}
+
+	if c.Build.Name == "" && len(c.Build.Steps) == 0 {
+		problems = append(problems, fmt.Errorf("Build: Missing a build command, set Name or Steps"))
+	}
+
+	for i, step := range c.Build.Steps {
+		if step.Command == "" {
+			problems = append(problems, fmt.Errorf("Build.Steps[%d]: Missing Command", i))
+		}
+	}
+
+	if !slices.Contains(Backends, c.Filewatcher.Backend) {
+		problems = append(problems, fmt.Errorf("Filewatcher.Backend: Unknown backend [%s], use one of %s", c.Filewatcher.Backend, strings.Join(Backends, ", ")))
+	}
+
+	for _, r := range c.Filewatcher.Ignore {
+		if _, err := regexp.Compile(r); err != nil {
+			problems = append(problems, fmt.Errorf("Filewatcher.Ignore: Failed to compile [%s]: [%v]", r, err))
+		}
+	}
+
+	for _, glob := range c.Filewatcher.IgnoreGlob {
+		if _, err := common.GlobToRegexp(glob); err != nil {
+			problems = append(problems, fmt.Errorf("Filewatcher.IgnoreGlob: %v", err))
+		}
+	}
+
+	for _, glob := range c.Filewatcher.Include {
+		if _, err := common.GlobToRegexp(glob); err != nil {
+			problems = append(problems, fmt.Errorf("Filewatcher.Include: %v", err))
+		}
+	}
+
+	for i, rule := range c.Rules {
+		if _, err := common.NewRule(rule.Glob, rule.Regex, rule.Action, rule.Command); err != nil {
+			problems = append(problems, fmt.Errorf("Rules[%d]: %v", i, err))
+		}
+	}
+
+	if c.SSE.Enable {
+		if err := checkPort("SSE.Port", c.SSE.Port); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	if c.Proxy.Enable {
+		if err := checkPort("Proxy.Port", c.Proxy.Port); err != nil {
+			problems = append(problems, err)
+		}
+
+		if target, err := url.Parse(c.Proxy.Target); err != nil || target.Host == "" {
+			problems = append(problems, fmt.Errorf("Proxy.Target: [%s] is not a URL like http://localhost:8080", c.Proxy.Target))
+		}
+
+		if !c.SSE.Enable {
+			problems = append(problems, fmt.Errorf("Proxy.Enable: The proxy needs SSE to be enabled"))
+		}
+	}
+
+	if !slices.Contains(LoggerStyles, c.Logger.Style) {
+		problems = append(problems, fmt.Errorf("Logger.Style: Unknown style [%s], use one of %s", c.Logger.Style, strings.Join(LoggerStyles, ", ")))
+	}
+
+	return problems
+}
+
+var (
+	tableRe = regexp.MustCompile(`^\s*\[\[?\s*([^\]]+?)\s*\]\]?`)
+	keyRe   = regexp.MustCompile(`^\s*([A-Za-z0-9_\-."' ]+?)\s*=`)
+)
+
+// keyLines maps every table and key in a TOML file to the line it is first defined on. The TOML
+// library does not keep track of positions, so this is a plain scan of the lines, which is
+// enough to point at a misspelled key.
+func keyLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	table := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if m := tableRe.FindStringSubmatch(line); m != nil {
+			table = unquoteKey(m[1])
+			if _, ok := lines[table]; !ok {
+				lines[table] = n
+			}
+			continue
+		}
+
+		if m := keyRe.FindStringSubmatch(line); m != nil {
+			key := unquoteKey(m[1])
+			if table != "" {
+				key = table + "." + key
+			}
+			if _, ok := lines[key]; !ok {
+				lines[key] = n
+			}
+		}
+	}
+	return lines
+}
+
+func unquoteKey(key string) string {
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(part), `"'`)
+	}
+	return strings.Join(parts, ".")
+}
+
+// unknownKeys reports the keys that did not match anything in Config. Keys below an unknown
+// table are left out, as the table itself is reported.
+func unknownKeys(md toml.MetaData, data []byte) []error {
+	lines := keyLines(data)
+	undecoded := md.Undecoded()
+	unknown := make(map[string]bool, len(undecoded))
+	problems := make([]error, 0)
+
+	for _, key := range undecoded {
+		name := strings.Join(key, ".")
+		unknown[name] = true
+		if len(key) > 1 && unknown[strings.Join(key[:len(key)-1], ".")] {
+			continue
+		}
+
+		if line, ok := lines[name]; ok {
+			problems = append(problems, fmt.Errorf("line %d: Unknown key [%s]", line, name))
+		} else {
+			problems = append(problems, fmt.Errorf("Unknown key [%s]", name))
+		}
+	}
+	return problems
+}
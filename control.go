@@ -0,0 +1,23 @@
+package main
+
+// control connects the control API to the dispatcher and the state tracker.
+type control struct {
+	dispatcher *Dispatcher
+	state      *StateTracker
+}
+
+func (c *control) Rebuild() bool {
+	return c.dispatcher.Send(CommandRebuild)
+}
+
+func (c *control) Pause() bool {
+	return c.dispatcher.Send(CommandPause)
+}
+
+func (c *control) Resume() bool {
+	return c.dispatcher.Send(CommandResume)
+}
+
+func (c *control) Status() any {
+	return c.state.Status()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/subfusc/kjor/file_watcher/common"
+)
+
+// Clock is the time source of the Debouncer. It exists so that tests can control time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+const (
+	defaultDebounce = 200 * time.Millisecond
+	defaultMaxWait  = 2 * time.Second
+)
+
+// Batch is a set of changes that arrived close enough in time to be handled as one.
+type Batch struct {
+	Paths []string
+	First time.Time
+	Last  time.Time
+	seen  map[string]bool
+}
+
+func (b *Batch) add(path string, when time.Time) {
+	if !b.seen[path] {
+		b.seen[path] = true
+		b.Paths = append(b.Paths, path)
+	}
+	b.Last = when
+}
+
+// Debouncer coalesces file events into batches. A batch ends when no events have arrived for
+// the quiet period, or when maxWait has passed since its first event, whichever comes first.
+// The latter makes sure a steady stream of changes still triggers a rebuild now and then.
+type Debouncer struct {
+	clock   Clock
+	quiet   time.Duration
+	maxWait time.Duration
+	batches chan Batch
+}
+
+// NewDebouncer returns a Debouncer using the defaults for a quiet period or maxWait that is not
+// positive, as either would end every batch right away.
+func NewDebouncer(quiet time.Duration, maxWait time.Duration, clock Clock) *Debouncer {
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	if quiet <= 0 {
+		quiet = defaultDebounce
+	}
+
+	if maxWait <= 0 {
+		maxWait = defaultMaxWait
+	}
+
+	return &Debouncer{
+		clock:   clock,
+		quiet:   quiet,
+		maxWait: maxWait,
+		batches: make(chan Batch, 1),
+	}
+}
+
+func (d *Debouncer) Batches() <-chan Batch {
+	return d.batches
+}
+
+// Run reads events from in until it is closed or ctx is cancelled. A pending batch is flushed
+// when in is closed. The batch stream is closed on return.
+func (d *Debouncer) Run(ctx context.Context, in <-chan common.Event) {
+	defer close(d.batches)
+
+	var pending *Batch
+	var quietC, maxC <-chan time.Time
+
+	flush := func() bool {
+		batch := *pending
+		pending, quietC, maxC = nil, nil, nil
+		select {
+		case d.batches <- batch:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		select {
+		case ev, ok := <-in:
+			if !ok {
+				if pending != nil {
+					flush()
+				}
+				return
+			}
+
+			if pending == nil {
+				pending = &Batch{First: d.clock.Now(), seen: make(map[string]bool)}
+				maxC = d.clock.After(d.maxWait)
+			}
+			pending.add(ev.FileName, d.clock.Now())
+			quietC = d.clock.After(d.quiet)
+		case <-quietC:
+			if !flush() {
+				return
+			}
+		case <-maxC:
+			if !flush() {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
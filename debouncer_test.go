@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/subfusc/kjor/file_watcher/common"
+)
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// fakeClock only moves when Advance is called. It counts calls to After, so that a test can wait
+// for the debouncer to have handled an event before moving time.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+	afters int
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	c := make(chan time.Time, 1)
+	fc.timers = append(fc.timers, fakeTimer{at: fc.now.Add(d), c: c})
+	fc.afters++
+	return c
+}
+
+// Advance moves time forward and fires the timers that are due.
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.now = fc.now.Add(d)
+	pending := fc.timers[:0]
+	for _, timer := range fc.timers {
+		if timer.at.After(fc.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.c <- fc.now
+		}
+	}
+	fc.timers = pending
+}
+
+func (fc *fakeClock) waitAfters(t *testing.T, n int) {
+	t.Helper()
+	waitFor(t, "the debouncer to set its timers", func() bool {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		return fc.afters >= n
+	})
+}
+
+type debouncerTest struct {
+	t      *testing.T
+	clock  *fakeClock
+	d      *Debouncer
+	in     chan common.Event
+	afters int
+}
+
+func newDebouncerTest(t *testing.T, quiet time.Duration, maxWait time.Duration) *debouncerTest {
+	clock := newFakeClock()
+	dt := &debouncerTest{
+		t:     t,
+		clock: clock,
+		d:     NewDebouncer(quiet, maxWait, clock),
+		in:    make(chan common.Event),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go dt.d.Run(ctx, dt.in)
+	return dt
+}
+
+// send hands path to the debouncer and waits for it to be handled. The first event of a batch
+// sets both the quiet and the max timer, later ones only the quiet timer.
+func (dt *debouncerTest) send(path string, first bool) {
+	dt.in <- common.Event{FileName: path}
+	dt.afters++
+	if first {
+		dt.afters++
+	}
+	dt.clock.waitAfters(dt.t, dt.afters)
+}
+
+func (dt *debouncerTest) expectNoBatch() {
+	dt.t.Helper()
+	select {
+	case batch := <-dt.d.Batches():
+		dt.t.Fatalf("Got batch %v too early", batch.Paths)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func (dt *debouncerTest) expectBatch(paths ...string) Batch {
+	dt.t.Helper()
+	select {
+	case batch := <-dt.d.Batches():
+		if !slices.Equal(batch.Paths, paths) {
+			dt.t.Fatalf("Got batch %v, want %v", batch.Paths, paths)
+		}
+		return batch
+	case <-time.After(time.Second):
+		dt.t.Fatalf("No batch, want %v", paths)
+	}
+	return Batch{}
+}
+
+func TestDebouncerQuietPeriodEndsBatch(t *testing.T) {
+	dt := newDebouncerTest(t, 100*time.Millisecond, time.Second)
+
+	dt.send("a.go", true)
+	dt.clock.Advance(60 * time.Millisecond)
+	dt.send("b.go", false)
+
+	// The quiet period starts over with every event.
+	dt.clock.Advance(60 * time.Millisecond)
+	dt.expectNoBatch()
+
+	dt.clock.Advance(40 * time.Millisecond)
+	batch := dt.expectBatch("a.go", "b.go")
+	if got := batch.Last.Sub(batch.First); got != 60*time.Millisecond {
+		t.Errorf("Batch spans %v, want 60ms", got)
+	}
+
+	// The next event starts a new batch.
+	dt.send("c.go", true)
+	dt.clock.Advance(100 * time.Millisecond)
+	dt.expectBatch("c.go")
+}
+
+func TestDebouncerMaxWaitCutsOffStream(t *testing.T) {
+	dt := newDebouncerTest(t, 100*time.Millisecond, 300*time.Millisecond)
+
+	// An event every 50ms never lets the quiet period end.
+	want := make([]string, 0)
+	for i, path := range []string{"1.go", "2.go", "3.go", "4.go", "5.go", "6.go"} {
+		dt.send(path, i == 0)
+		want = append(want, path)
+		dt.clock.Advance(50 * time.Millisecond)
+	}
+
+	batch := dt.expectBatch(want...)
+	if got := batch.Last.Sub(batch.First); got != 250*time.Millisecond {
+		t.Errorf("Batch spans %v, want 250ms", got)
+	}
+}
+
+func TestDebouncerDefaults(t *testing.T) {
+	dt := newDebouncerTest(t, 0, -1)
+
+	// Without the defaults every event would be a batch of its own.
+	dt.send("a.go", true)
+	dt.clock.Advance(150 * time.Millisecond)
+	dt.send("b.go", false)
+	dt.expectNoBatch()
+
+	dt.clock.Advance(defaultDebounce)
+	dt.expectBatch("a.go", "b.go")
+
+	// A stream of events is cut off by the default maxWait.
+	want := make([]string, 0)
+	for i := range 13 {
+		path := fmt.Sprintf("%d.go", i)
+		dt.send(path, i == 0)
+		want = append(want, path)
+		dt.clock.Advance(150 * time.Millisecond)
+	}
+	dt.expectNoBatch()
+
+	dt.clock.Advance(defaultMaxWait - 13*150*time.Millisecond)
+	dt.expectBatch(want...)
+}
+
+func TestDebouncerCollapsesDuplicates(t *testing.T) {
+	dt := newDebouncerTest(t, 100*time.Millisecond, time.Second)
+
+	dt.send("a.go", true)
+	dt.send("a.go", false)
+	dt.send("b.go", false)
+	dt.send("a.go", false)
+
+	dt.clock.Advance(100 * time.Millisecond)
+	dt.expectBatch("a.go", "b.go")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// How many lines of build output are kept for the browser.
+const buildOutputLines = 200
+
+// Diagnostic is a single compiler message pointing at a place in a file. Column is 0 when the
+// message does not have one.
+type Diagnostic struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+// Matches `path:line:col: msg` and `path:line: msg`, which covers the Go toolchain and most
+// other compilers and linters. The path has no whitespace, so that log lines like
+// `Listening on 127.0.0.1:8080: ok` are not taken for one.
+var diagnosticRe = regexp.MustCompile(`^([^\s:]+):(\d+):(?:(\d+):)?\s*(.*)$`)
+
+// ParseDiagnostics picks the diagnostics out of build output. Indented lines following a
+// diagnostic, like the have/want lines of the Go compiler, are added to its message.
+func ParseDiagnostics(lines []string) []Diagnostic {
+	diagnostics := make([]Diagnostic, 0)
+	for _, line := range lines {
+		m := diagnosticRe.FindStringSubmatch(line)
+		if m == nil {
+			last := len(diagnostics) - 1
+			if last >= 0 && strings.HasPrefix(line, "\t") {
+				diagnostics[last].Message += "\n" + strings.TrimSpace(line)
+			}
+			continue
+		}
+
+		d := Diagnostic{File: m[1], Message: m[4]}
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Column, _ = strconv.Atoi(m[3])
+		diagnostics = append(diagnostics, d)
+	}
+	return diagnostics
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseDiagnostics(t *testing.T) {
+	lines := []string{
+		"# github.com/subfusc/kjor",
+		"./main.go:12:5: undefined: foo",
+		"./process.go:40:2: cannot use x (variable of type int) as string value in argument to f",
+		"\thave (int)",
+		"\twant (string)",
+		"config/config.go:7: syntax error",
+		"Listening on 127.0.0.1:8080: ok",
+		"server started at host:80: done",
+	}
+
+	want := []Diagnostic{
+		{File: "./main.go", Line: 12, Column: 5, Message: "undefined: foo"},
+		{File: "./process.go", Line: 40, Column: 2, Message: "cannot use x (variable of type int) as string value in argument to f\nhave (int)\nwant (string)"},
+		{File: "config/config.go", Line: 7, Message: "syntax error"},
+	}
+
+	if got := ParseDiagnostics(lines); !slices.Equal(got, want) {
+		t.Errorf("ParseDiagnostics() =\n%+v\nwant\n%+v", got, want)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/subfusc/kjor/config"
+	"github.com/subfusc/kjor/file_watcher/common"
+)
+
+// Command is a request to the dispatcher that does not come from the file watcher.
+type Command int
+
+const (
+	CommandRebuild Command = iota
+	CommandRestart
+	CommandPause
+	CommandResume
+	CommandTogglePause
+)
+
+var commandNames = map[Command]string{
+	CommandRebuild:     "rebuild",
+	CommandRestart:     "restart",
+	CommandPause:       "pause",
+	CommandResume:      "resume",
+	CommandTogglePause: "toggle-pause",
+}
+
+func (c Command) String() string {
+	return commandNames[c]
+}
+
+type jobResult struct {
+	job       int
+	action    common.Action
+	err       error
+	restarted bool
+}
+
+// Dispatcher decides what a batch of changes requires using the configured rules, and carries it
+// out. Builds, restarts and commands run in the background, and are cancelled when a newer batch
+// needs one of them. The job replacing a cancelled one does what both of them would have done.
+type Dispatcher struct {
+	proc            *Process
+	rules           common.Rules
+	root            string
+	publish         func(eventType string, data map[string]any)
+	logger          *slog.Logger
+	results         chan jobResult
+	commands        chan Command
+	state           *StateTracker
+	cancelJob       context.CancelFunc
+	job             int
+	running         common.Action
+	runningCommands [][]string
+}
+
+func NewDispatcher(c *config.Config, proc *Process, root string, publish func(eventType string, data map[string]any), logger *slog.Logger) (*Dispatcher, error) {
+	rules := make(common.Rules, 0, len(c.Rules))
+	for _, rc := range c.Rules {
+		rule, err := common.NewRule(rc.Glob, rc.Regex, rc.Action, rc.Command)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return &Dispatcher{
+		proc:      proc,
+		rules:     rules,
+		root:      root,
+		publish:   publish,
+		logger:    logger,
+		results:   make(chan jobResult),
+		commands:  make(chan Command, 16),
+		state:     proc.State(),
+		cancelJob: func() {},
+	}, nil
+}
+
+// Send queues a command for the dispatcher. It never blocks, and returns false if the command
+// had to be dropped because the queue is full.
+func (d *Dispatcher) Send(cmd Command) bool {
+	select {
+	case d.commands <- cmd:
+		return true
+	default:
+		d.logger.Warn("Command queue full, dropping command", "command", cmd)
+		return false
+	}
+}
+
+func (d *Dispatcher) command(ctx context.Context, cmd Command) {
+	switch cmd {
+	case CommandRebuild:
+		d.logger.Info("Rebuilding on request")
+		d.Rebuild(ctx)
+	case CommandRestart:
+		d.logger.Info("Restarting on request")
+		d.start(ctx, common.ActionRestartOnly, nil)
+	case CommandPause:
+		d.logger.Info("Paused, changes are ignored until resumed")
+		d.state.SetPaused(true)
+	case CommandResume:
+		d.logger.Info("Resumed")
+		d.state.SetPaused(false)
+	case CommandTogglePause:
+		if d.state.Paused() {
+			d.command(ctx, CommandResume)
+		} else {
+			d.command(ctx, CommandPause)
+		}
+	}
+}
+
+// Rebuild builds and restarts the program like a change would, and reports the result the same
+// way. It is used for the first build, and must be called from the goroutine calling Run.
+func (d *Dispatcher) Rebuild(ctx context.Context) {
+	d.start(ctx, common.ActionRebuild, nil)
+}
+
+// Run dispatches batches and commands until the batch stream is closed.
+func (d *Dispatcher) Run(ctx context.Context, batches <-chan Batch) {
+	defer func() { d.cancelJob() }()
+
+	for batches != nil {
+		select {
+		case batch, ok := <-batches:
+			if !ok {
+				batches = nil
+				continue
+			}
+			if d.state.Paused() {
+				d.logger.Debug("Paused, ignoring changes", "paths", batch.Paths)
+				continue
+			}
+			d.dispatch(ctx, batch)
+		case cmd := <-d.commands:
+			d.command(ctx, cmd)
+		case res := <-d.results:
+			d.report(res)
+		}
+	}
+}
+
+func (d *Dispatcher) relative(path string) string {
+	rel, err := filepath.Rel(d.root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// plan returns the strongest action required by the batch, the commands of matching run-command
+// rules and the changed files matching css-inject rules.
+func (d *Dispatcher) plan(batch Batch) (common.Action, [][]string, []string) {
+	action := common.ActionIgnore
+	commands := make([][]string, 0)
+	cssPaths := make([]string, 0)
+
+	for _, path := range batch.Paths {
+		rel := d.relative(path)
+		rule := d.rules.Match(rel)
+		pathAction := common.ActionRebuild
+		if rule != nil {
+			pathAction = rule.Action
+		}
+
+		switch {
+		case pathAction == common.ActionCSSInject:
+			cssPaths = append(cssPaths, rel)
+		case pathAction == common.ActionRunCommand && !slices.ContainsFunc(commands, func(c []string) bool { return slices.Equal(c, rule.Command) }):
+			commands = append(commands, rule.Command)
+		}
+
+		action = max(action, pathAction)
+	}
+
+	return action, commands, cssPaths
+}
+
+func (d *Dispatcher) dispatch(ctx context.Context, batch Batch) {
+	action, commands, cssPaths := d.plan(batch)
+	d.logger.Debug("Files changed", "paths", batch.Paths, "action", action)
+
+	switch action {
+	case common.ActionIgnore:
+		return
+	case common.ActionCSSInject:
+		d.publish("css_changed", map[string]any{"paths": cssPaths})
+		return
+	case common.ActionBrowserReload:
+		// Nothing was restarted, so there is nothing to wait for before reloading.
+		d.publish("build_action", map[string]any{"restarted": true, "ready": true})
+		return
+	}
+
+	d.start(ctx, action, commands)
+}
+
+// start runs a job in the background. A newer change makes any build, restart or command in
+// progress stale, so a running job is cancelled first. What the cancelled job had left to do is
+// not lost, so a restart-only change during a build still rebuilds.
+func (d *Dispatcher) start(ctx context.Context, action common.Action, commands [][]string) {
+	d.cancelJob()
+	if d.running != common.ActionIgnore {
+		action = max(action, d.running)
+		for _, command := range d.runningCommands {
+			if !slices.ContainsFunc(commands, func(c []string) bool { return slices.Equal(c, command) }) {
+				commands = append(commands, command)
+			}
+		}
+	}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	d.cancelJob = cancel
+	d.job++
+	d.running = action
+	d.runningCommands = commands
+
+	job := d.job
+	go func() {
+		res := d.runJob(jobCtx, action, commands)
+		res.job = job
+		select {
+		case d.results <- res:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+func (d *Dispatcher) runJob(ctx context.Context, action common.Action, commands [][]string) jobResult {
+	res := jobResult{action: action}
+
+	for _, command := range commands {
+		if err := d.proc.RunCommand(ctx, command); err != nil {
+			if ctx.Err() != nil {
+				res.err = ProcessBuildCancelled
+			} else {
+				res.err = &BuildError{Step: strings.Join(command, " "), Err: err}
+			}
+			return res
+		}
+	}
+
+	switch action {
+	case common.ActionRunCommand:
+		res.restarted = true
+	case common.ActionRestartOnly:
+		res.err, res.restarted = d.proc.RestartProgram(ctx)
+	case common.ActionRebuild:
+		res.err, res.restarted = d.proc.Restart(ctx)
+	}
+	return res
+}
+
+func (d *Dispatcher) report(res jobResult) {
+	if res.job == d.job {
+		d.running = common.ActionIgnore
+		d.runningCommands = nil
+	}
+
+	switch {
+	case errors.Is(res.err, ProcessBuildFailed):
+		data := map[string]any{"message": "Build failed"}
+		var buildErr *BuildError
+		if errors.As(res.err, &buildErr) {
+			data["message"] = fmt.Sprintf("Build failed in step %s", buildErr.Step)
+			data["step"] = buildErr.Step
+			data["output"] = buildErr.Output
+			data["diagnostics"] = buildErr.Diagnostics
+		}
+		d.publish("build_message", data)
+	case errors.Is(res.err, ProcessBuildCancelled):
+		d.publish("build_cancelled", map[string]any{})
+	case errors.Is(res.err, ProcessStartFailed):
+		d.publish("start_failed", map[string]any{"message": res.err.Error()})
+	case res.restarted:
+		// Running a command does not restart the program, so the browser can reload right away.
+		ready := res.action == common.ActionRunCommand || d.proc.HasReadinessProbe()
+		d.publish("build_action", map[string]any{"restarted": true, "ready": ready})
+	}
+
+	if res.err != nil && !errors.Is(res.err, ProcessBuildFailed) && !errors.Is(res.err, ProcessBuildCancelled) && !errors.Is(res.err, ProcessStartFailed) {
+		d.logger.Error("Failed to handle changes", "action", res.action, "err", res.err)
+	}
+}
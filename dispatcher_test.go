@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/subfusc/kjor/config"
+)
+
+type published struct {
+	eventType string
+	data      map[string]any
+}
+
+func TestFirstBuildFailureIsReported(t *testing.T) {
+	c := config.DefaultConfig()
+	c.Program = config.ProgConfig{Name: "true"}
+	c.Build = config.BuildConfig{Steps: []config.BuildStep{
+		{Name: "compile", Command: "sh", Args: []string{"-c", "echo './main.go:3:5: undefined: foo' >&2; exit 1"}},
+	}}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	p, err := NewProcess(c, logger, io.Discard, io.Discard)
+	if err != nil {
+		t.Fatalf("NewProcess: %v", err)
+	}
+	t.Cleanup(p.Stop)
+
+	events := make(chan published, 16)
+	publish := func(eventType string, data map[string]any) {
+		events <- published{eventType, data}
+	}
+	d, err := NewDispatcher(c, p, t.TempDir(), publish, logger)
+	if err != nil {
+		t.Fatalf("NewDispatcher: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	batches := make(chan Batch)
+	d.Rebuild(ctx)
+	go d.Run(ctx, batches)
+	defer close(batches)
+
+	select {
+	case event := <-events:
+		if event.eventType != "build_message" || event.data["step"] != "compile" {
+			t.Fatalf("Got %s %v, want a build_message for step compile", event.eventType, event.data)
+		}
+		want := Diagnostic{File: "./main.go", Line: 3, Column: 5, Message: "undefined: foo"}
+		if diagnostics, _ := event.data["diagnostics"].([]Diagnostic); len(diagnostics) != 1 || diagnostics[0] != want {
+			t.Errorf("Got diagnostics %+v, want %+v", event.data["diagnostics"], want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The failed first build was not reported")
+	}
+}
@@ -0,0 +1,277 @@
+package common
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	GitignoreFile  = ".gitignore"
+	KjorignoreFile = ".kjorignore"
+)
+
+type gitignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Gitignore is the patterns of a single ignore file, which apply to the paths below its
+// directory. Base is that directory, relative to the watch root and slash separated, or "" for
+// the root itself.
+type Gitignore struct {
+	Base     string
+	patterns []gitignorePattern
+}
+
+// ParseGitignore reads patterns in the gitignore format: `#` starts a comment, `!` negates a
+// pattern, a trailing `/` only matches directories and a pattern with a slash anywhere but at
+// the end is anchored to the directory of the file.
+func ParseGitignore(base string, r io.Reader) (*Gitignore, error) {
+	g := &Gitignore{Base: base}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		// Trailing spaces are ignored unless escaped.
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p := gitignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+		}
+
+		body, err := globToRegexpBody(line)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.re, err = regexp.Compile(body + "$"); err != nil {
+			return nil, fmt.Errorf("Failed to compile ignore pattern %q: [%v]", line, err)
+		}
+		g.patterns = append(g.patterns, p)
+	}
+
+	return g, scanner.Err()
+}
+
+// Match tells whether the patterns decide anything about rel, a path relative to the watch root,
+// and if so whether it is ignored. The last matching pattern decides.
+func (g *Gitignore) Match(rel string, isDir bool) (ignored bool, matched bool) {
+	if g.Base != "" {
+		if !strings.HasPrefix(rel, g.Base+"/") {
+			return false, false
+		}
+		rel = strings.TrimPrefix(rel, g.Base+"/")
+	}
+
+	for i := len(g.patterns) - 1; i >= 0; i-- {
+		p := g.patterns[i]
+		if p.dirOnly && !isDir {
+			continue
+		}
+
+		if p.re.MatchString(rel) {
+			return !p.negate, true
+		}
+	}
+	return false, false
+}
+
+// IgnoreFiles decides what is ignored by the .kjorignore files, and optionally the .gitignore
+// files, in the watched trees. Files are read the first time they are needed, and read again
+// after Invalidate. It is safe for concurrent use.
+type IgnoreFiles struct {
+	useGitignore bool
+	mu           sync.Mutex
+	roots        []string
+	byDir        map[string][]*Gitignore
+}
+
+func NewIgnoreFiles(useGitignore bool) *IgnoreFiles {
+	return &IgnoreFiles{
+		useGitignore: useGitignore,
+		roots:        make([]string, 0),
+		byDir:        make(map[string][]*Gitignore),
+	}
+}
+
+// AddRoot makes the ignore files below root apply to paths in it.
+func (f *IgnoreFiles) AddRoot(root string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.roots = append(f.roots, filepath.Clean(root))
+}
+
+// RemoveRoot stops the ignore files below root from applying.
+func (f *IgnoreFiles) RemoveRoot(root string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	root = filepath.Clean(root)
+	for i, r := range f.roots {
+		if r == root {
+			f.roots = append(f.roots[:i], f.roots[i+1:]...)
+			break
+		}
+	}
+
+	for dir := range f.byDir {
+		if dir == root || strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			delete(f.byDir, dir)
+		}
+	}
+}
+
+// IsIgnoreFile tells whether a change to path changes what is ignored.
+func (f *IgnoreFiles) IsIgnoreFile(path string) bool {
+	name := filepath.Base(path)
+	if name == KjorignoreFile || (f.useGitignore && name == GitignoreFile) {
+		return true
+	}
+
+	if !f.useGitignore || name != "exclude" {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path = filepath.Clean(path)
+	return slices.ContainsFunc(f.roots, func(root string) bool {
+		return path == filepath.Join(root, ".git", "info", "exclude")
+	})
+}
+
+// Invalidate forgets the ignore files of dir, so they are read again when needed.
+func (f *IgnoreFiles) Invalidate(dir string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dir = filepath.Clean(dir)
+	delete(f.byDir, dir)
+	// .git/info/exclude belongs to the root two levels up.
+	if filepath.Base(dir) == "info" && filepath.Base(filepath.Dir(dir)) == ".git" {
+		delete(f.byDir, filepath.Dir(filepath.Dir(dir)))
+	}
+}
+
+func (f *IgnoreFiles) root(path string) (string, bool) {
+	best := ""
+	for _, root := range f.roots {
+		if (path == root || strings.HasPrefix(path, root+string(filepath.Separator))) && len(root) > len(best) {
+			best = root
+		}
+	}
+	return best, best != ""
+}
+
+func readIgnoreFile(base string, path string) (*Gitignore, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseGitignore(base, file)
+}
+
+// load returns the ignore files of dir, in increasing order of precedence.
+func (f *IgnoreFiles) load(root string, dir string) []*Gitignore {
+	if files, ok := f.byDir[dir]; ok {
+		return files
+	}
+
+	rel, _ := filepath.Rel(root, dir)
+	base := filepath.ToSlash(rel)
+	if base == "." {
+		base = ""
+	}
+
+	names := []string{}
+	if f.useGitignore {
+		if dir == root {
+			names = append(names, filepath.Join(".git", "info", "exclude"))
+		}
+		names = append(names, GitignoreFile)
+	}
+	names = append(names, KjorignoreFile)
+
+	files := make([]*Gitignore, 0)
+	for _, name := range names {
+		// An unreadable or broken file is treated as empty, as there is nobody to tell.
+		if g, err := readIgnoreFile(base, filepath.Join(dir, name)); err == nil && g != nil {
+			files = append(files, g)
+		}
+	}
+	f.byDir[dir] = files
+	return files
+}
+
+// match applies the ignore files from root down to the directory of path.
+func (f *IgnoreFiles) match(root string, path string, isDir bool) bool {
+	rel, _ := filepath.Rel(root, path)
+	rel = filepath.ToSlash(rel)
+
+	dirs := make([]string, 0)
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == root {
+			break
+		}
+	}
+	slices.Reverse(dirs)
+
+	ignored := false
+	for _, dir := range dirs {
+		for _, g := range f.load(root, dir) {
+			if i, ok := g.Match(rel, isDir); ok {
+				ignored = i
+			}
+		}
+	}
+	return ignored
+}
+
+// Ignored tells whether path is ignored. Like git, a path inside an ignored directory is ignored
+// no matter what the patterns say about the path itself. Paths outside every root are never
+// ignored.
+func (f *IgnoreFiles) Ignored(path string, isDir bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path = filepath.Clean(path)
+	root, ok := f.root(path)
+	if !ok || path == root {
+		return false
+	}
+
+	// Check every directory on the way, starting closest to the root.
+	rel, _ := filepath.Rel(root, path)
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i := 1; i < len(parts); i++ {
+		if f.match(root, filepath.Join(root, filepath.Join(parts[:i]...)), true) {
+			return true
+		}
+	}
+	return f.match(root, path, isDir)
+}
@@ -0,0 +1,205 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseGitignore(t *testing.T) {
+	patterns := strings.Join([]string{
+		"# Comments and empty lines are skipped.",
+		"",
+		"*.log",
+		"!keep.log",
+		"build/",
+		"/vendor",
+		"doc/*.txt",
+		"trailing   ",
+		"escaped\\ ",
+	}, "\n")
+	g, err := ParseGitignore("", strings.NewReader(patterns))
+	if err != nil {
+		t.Fatalf("ParseGitignore: %v", err)
+	}
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+		matched bool
+	}{
+		{"main.go", false, false, false},
+		{"# Comments and empty lines are skipped.", false, false, false},
+		{"debug.log", false, true, true},
+		{"sub/debug.log", false, true, true},
+		// The last matching pattern decides.
+		{"keep.log", false, false, true},
+		{"sub/keep.log", false, false, true},
+		// A trailing slash only matches directories.
+		{"build", true, true, true},
+		{"sub/build", true, true, true},
+		{"build", false, false, false},
+		// A leading slash, or a slash in the middle, anchors to the directory of the file.
+		{"vendor", true, true, true},
+		{"sub/vendor", true, false, false},
+		{"doc/a.txt", false, true, true},
+		{"sub/doc/a.txt", false, false, false},
+		{"doc/sub/a.txt", false, false, false},
+		// Trailing spaces are dropped unless escaped.
+		{"trailing", false, true, true},
+		{"escaped ", false, true, true},
+		{"escaped", false, false, false},
+	}
+
+	for _, test := range tests {
+		ignored, matched := g.Match(test.path, test.isDir)
+		if ignored != test.ignored || matched != test.matched {
+			t.Errorf("Match(%q, %t) = %t, %t, want %t, %t", test.path, test.isDir, ignored, matched, test.ignored, test.matched)
+		}
+	}
+}
+
+func TestParseGitignoreBase(t *testing.T) {
+	g, err := ParseGitignore("web/src", strings.NewReader("*.tmp\n/gen\n"))
+	if err != nil {
+		t.Fatalf("ParseGitignore: %v", err)
+	}
+
+	tests := []struct {
+		path    string
+		ignored bool
+	}{
+		{"web/src/a.tmp", true},
+		{"web/src/deep/a.tmp", true},
+		{"web/src/gen", true},
+		{"web/src/deep/gen", false},
+		{"a.tmp", false},
+		{"web/a.tmp", false},
+		{"web/srcx/a.tmp", false},
+	}
+
+	for _, test := range tests {
+		if ignored, _ := g.Match(test.path, false); ignored != test.ignored {
+			t.Errorf("Match(%q) = %t, want %t", test.path, ignored, test.ignored)
+		}
+	}
+}
+
+func TestParseGitignoreBrokenPattern(t *testing.T) {
+	if _, err := ParseGitignore("", strings.NewReader("[abc\n")); err == nil {
+		t.Error("ParseGitignore accepted an unterminated character class")
+	}
+}
+
+func writeIgnoreFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	root := t.TempDir()
+	writeIgnoreFile(t, filepath.Join(root, GitignoreFile), "*.log\n!keep.log\nbuild/\n")
+	writeIgnoreFile(t, filepath.Join(root, "web", GitignoreFile), "*.tmp\n!important.log\n")
+	writeIgnoreFile(t, filepath.Join(root, KjorignoreFile), "*.bak\n")
+	writeIgnoreFile(t, filepath.Join(root, ".git", "info", "exclude"), "secret\n")
+
+	f := NewIgnoreFiles(true)
+	f.AddRoot(root)
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"main.go", false, false},
+		{"debug.log", false, true},
+		{"keep.log", false, false},
+		{"main.go.bak", false, true},
+		{"secret", false, true},
+		{"build", true, true},
+		// Inside an ignored directory nothing can be taken back.
+		{"build/keep.log", false, true},
+		// Nested files only apply below their directory, and take precedence.
+		{"web/a.tmp", false, true},
+		{"a.tmp", false, false},
+		{"web/important.log", false, false},
+		{"web/other.log", false, true},
+	}
+
+	for _, test := range tests {
+		if got := f.Ignored(filepath.Join(root, test.path), test.isDir); got != test.ignored {
+			t.Errorf("Ignored(%q) = %t, want %t", test.path, got, test.ignored)
+		}
+	}
+
+	if f.Ignored(filepath.Join(t.TempDir(), "debug.log"), false) {
+		t.Error("A path outside every root was ignored")
+	}
+
+	for _, test := range []struct {
+		path       string
+		ignoreFile bool
+	}{
+		{GitignoreFile, true},
+		{"web/" + GitignoreFile, true},
+		{"web/" + KjorignoreFile, true},
+		{".git/info/exclude", true},
+		// Only the exclude file of git is one.
+		{"exclude", false},
+		{"web/.git/info/exclude", false},
+		{"main.go", false},
+	} {
+		if got := f.IsIgnoreFile(filepath.Join(root, test.path)); got != test.ignoreFile {
+			t.Errorf("IsIgnoreFile(%q) = %t, want %t", test.path, got, test.ignoreFile)
+		}
+	}
+}
+
+func TestIgnoreFilesWithoutGitignore(t *testing.T) {
+	root := t.TempDir()
+	writeIgnoreFile(t, filepath.Join(root, GitignoreFile), "*.log\n")
+	writeIgnoreFile(t, filepath.Join(root, KjorignoreFile), "*.bak\n")
+
+	f := NewIgnoreFiles(false)
+	f.AddRoot(root)
+
+	if f.Ignored(filepath.Join(root, "debug.log"), false) {
+		t.Error(".gitignore was used without useGitignore")
+	}
+	if !f.Ignored(filepath.Join(root, "main.go.bak"), false) {
+		t.Error(".kjorignore was not used")
+	}
+	if f.IsIgnoreFile(filepath.Join(root, GitignoreFile)) {
+		t.Error(".gitignore counts as an ignore file without useGitignore")
+	}
+}
+
+func TestIgnoreFilesInvalidate(t *testing.T) {
+	root := t.TempDir()
+	ignoreFile := filepath.Join(root, "web", KjorignoreFile)
+	writeIgnoreFile(t, ignoreFile, "*.tmp\n")
+
+	f := NewIgnoreFiles(false)
+	f.AddRoot(root)
+	path := filepath.Join(root, "web", "a.tmp")
+	if !f.Ignored(path, false) {
+		t.Fatal("Not ignored by the first version of the file")
+	}
+
+	writeIgnoreFile(t, ignoreFile, "*.log\n")
+	if !f.Ignored(path, false) {
+		t.Error("The file was read again before Invalidate")
+	}
+
+	f.Invalidate(filepath.Dir(ignoreFile))
+	if f.Ignored(path, false) {
+		t.Error("Still ignored after Invalidate")
+	}
+}
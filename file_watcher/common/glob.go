@@ -0,0 +1,72 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// GlobToRegexp compiles a glob into a regular expression matching slash separated paths relative
+// to the watch root.
+//
+// `*` and `?` match within a single path element, `**/` matches any number of directories and a
+// trailing `**` matches everything below. A glob without a slash matches the name at any depth,
+// like `*.css`. A glob matching a directory also matches everything inside it.
+func GlobToRegexp(glob string) (*regexp.Regexp, error) {
+	body, err := globToRegexpBody(glob)
+	if err != nil {
+		return nil, err
+	}
+	return regexp.Compile(body + "(?:/.*)?$")
+}
+
+// globToRegexpBody translates glob into an anchored regular expression without an end, so the
+// caller decides whether paths below a match also match.
+func globToRegexpBody(glob string) (string, error) {
+	buf := strings.Builder{}
+	buf.WriteString("^")
+
+	if !strings.Contains(strings.TrimSuffix(glob, "/"), "/") {
+		buf.WriteString("(?:.*/)?")
+	}
+	glob = strings.TrimPrefix(strings.TrimSuffix(glob, "/"), "/")
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			switch {
+			case strings.HasPrefix(glob[i:], "**/"):
+				buf.WriteString("(?:.*/)?")
+				i += 2
+			case strings.HasPrefix(glob[i:], "**"):
+				buf.WriteString(".*")
+				i++
+			default:
+				buf.WriteString("[^/]*")
+			}
+		case '?':
+			buf.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("Unterminated character class in glob %q", glob)
+			}
+
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			buf.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return buf.String(), nil
+}
@@ -0,0 +1,215 @@
+package common
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Matcher decides which files the watchers care about. It is shared by all backends, so that
+// they agree on what is watched and what is reported.
+//
+// Paths are matched relative to the watch root they are in and slash separated. Ignore regexes
+// are matched against both the name and the relative path, so `~$` and `^web/dist/` both work.
+// Ignore and include globs use the syntax of GlobToRegexp. Directories are matched with a
+// trailing slash. When there are include globs, only changes to files matching one of them are
+// reported, but every directory is still watched.
+//
+// A watch root is either a directory, which covers everything below it, or a single file. Single
+// files always match, and other absolute paths outside every root never do.
+//
+// Paths given to IgnorePath, like the build output, never match.
+type Matcher struct {
+	ignore      []*regexp.Regexp
+	ignoreGlobs []*regexp.Regexp
+	include     []*regexp.Regexp
+	files       *IgnoreFiles
+	mu          sync.Mutex
+	fileRoots   map[string]bool
+	paths       map[string]bool
+}
+
+func NewMatcher(ignore []string, ignoreGlobs []string, include []string, useGitignore bool) (*Matcher, error) {
+	m := &Matcher{
+		ignore:      make([]*regexp.Regexp, 0, len(ignore)),
+		ignoreGlobs: make([]*regexp.Regexp, 0, len(ignoreGlobs)),
+		include:     make([]*regexp.Regexp, 0, len(include)),
+		files:       NewIgnoreFiles(useGitignore),
+		fileRoots:   make(map[string]bool),
+		paths:       make(map[string]bool),
+	}
+
+	for _, r := range ignore {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to compile an ignore regex: [%v]", err)
+		}
+		m.ignore = append(m.ignore, re)
+	}
+
+	for _, glob := range ignoreGlobs {
+		re, err := GlobToRegexp(glob)
+		if err != nil {
+			return nil, err
+		}
+		m.ignoreGlobs = append(m.ignoreGlobs, re)
+	}
+
+	for _, glob := range include {
+		re, err := GlobToRegexp(glob)
+		if err != nil {
+			return nil, err
+		}
+		m.include = append(m.include, re)
+	}
+
+	return m, nil
+}
+
+// AddRoot makes paths below the directory root match relative to it.
+func (m *Matcher) AddRoot(root string) {
+	m.files.AddRoot(root)
+}
+
+// AddFile makes changes to the single file p match.
+func (m *Matcher) AddFile(p string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fileRoots[filepath.Clean(p)] = true
+}
+
+// Remove removes the directory or file root p.
+func (m *Matcher) Remove(p string) {
+	m.mu.Lock()
+	delete(m.fileRoots, filepath.Clean(p))
+	m.mu.Unlock()
+
+	m.files.RemoveRoot(p)
+}
+
+// IgnorePath makes changes to the file at the absolute path p never match. With prefix, the files
+// next to it whose names start with its name are ignored too, like the files go build writes
+// next to its output.
+func (m *Matcher) IgnorePath(p string, prefix bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.paths[filepath.Clean(p)] = prefix
+}
+
+// isIgnoredPath tells whether p is ignored by IgnorePath. A relative path is only a name, so it
+// is compared with the names of the ignored paths.
+func (m *Matcher) isIgnoredPath(p string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p = filepath.Clean(p)
+	for ignored, prefix := range m.paths {
+		if filepath.IsAbs(p) && filepath.Dir(p) != filepath.Dir(ignored) {
+			continue
+		}
+
+		name, ignoredName := filepath.Base(p), filepath.Base(ignored)
+		if name == ignoredName || (prefix && strings.HasPrefix(name, ignoredName)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Matcher) isFileRoot(p string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fileRoots[filepath.Clean(p)]
+}
+
+// Covers tells whether the directory dir needs to be watched, because it is inside a directory
+// root or holds a single file root.
+func (m *Matcher) Covers(dir string) bool {
+	if _, ok := m.rel(dir); ok {
+		return true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir = filepath.Clean(dir)
+	for p := range m.fileRoots {
+		if filepath.Dir(p) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// rel returns p relative to its watch root, and false for absolute paths outside every
+// directory root. Relative paths, like the bare names fanotify reports without
+// CAP_DAC_READ_SEARCH, are matched as they are.
+func (m *Matcher) rel(p string) (string, bool) {
+	if !filepath.IsAbs(p) {
+		return filepath.ToSlash(p), true
+	}
+
+	m.files.mu.Lock()
+	root, ok := m.files.root(filepath.Clean(p))
+	m.files.mu.Unlock()
+
+	if !ok {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(root, p)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// ignored tells whether rel is ignored by the Ignore regexes and globs.
+func (m *Matcher) ignored(rel string, isDir bool) bool {
+	if rel == "." {
+		return false
+	}
+
+	name := path.Base(rel)
+	if isDir {
+		rel += "/"
+	}
+	return RegexpAny(m.ignore, name) || RegexpAny(m.ignore, rel) || RegexpAny(m.ignoreGlobs, rel)
+}
+
+// SkipDir tells whether the directory at p, and everything below it, should not be watched.
+func (m *Matcher) SkipDir(p string) bool {
+	rel, ok := m.rel(p)
+	return !ok || m.ignored(rel, true) || m.files.Ignored(p, true)
+}
+
+// Match tells whether a change to p should be reported.
+func (m *Matcher) Match(p string, isDir bool) bool {
+	if m.isIgnoredPath(p) {
+		return false
+	}
+
+	if m.isFileRoot(p) {
+		return true
+	}
+
+	rel, ok := m.rel(p)
+	if !ok || m.ignored(rel, isDir) || m.files.Ignored(p, isDir) {
+		return false
+	}
+	return len(m.include) == 0 || RegexpAny(m.include, rel)
+}
+
+// IsIgnoreFile tells whether a change to p changes what is ignored.
+func (m *Matcher) IsIgnoreFile(p string) bool {
+	return m.files.IsIgnoreFile(p)
+}
+
+// Changed lets the matcher know that p has changed, so that changes to ignore files take effect.
+func (m *Matcher) Changed(p string) {
+	if m.files.IsIgnoreFile(p) {
+		m.files.Invalidate(filepath.Dir(p))
+	}
+}
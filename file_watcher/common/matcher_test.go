@@ -0,0 +1,282 @@
+package common
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob    string
+		path    string
+		matches bool
+	}{
+		// Without a slash the name matches at any depth.
+		{"*.css", "style.css", true},
+		{"*.css", "web/css/style.css", true},
+		{"*.css", "style.css.map", false},
+		{"main.go", "cmd/kjor/main.go", true},
+
+		// `*` and `?` stay within a path element.
+		{"web/*.js", "web/app.js", true},
+		{"web/*.js", "web/lib/app.js", false},
+		{"?.go", "a.go", true},
+		{"?.go", "ab.go", false},
+
+		// `**/` matches any number of directories, none included.
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "a/b/c/main.go", true},
+		{"web/**/*.tmpl", "web/index.tmpl", true},
+		{"web/**/*.tmpl", "web/pages/admin/index.tmpl", true},
+		{"web/**/*.tmpl", "other/web/index.tmpl", false},
+
+		// A trailing `**` matches everything below, but not the directory itself.
+		{"templates/**", "templates/index.html", true},
+		{"templates/**", "templates/a/b/index.html", true},
+		{"templates/**", "templates", false},
+
+		// A slash anywhere but at the end anchors the glob to the root.
+		{"internal/gen/*.go", "internal/gen/api.go", true},
+		{"internal/gen/*.go", "x/internal/gen/api.go", false},
+		{"internal/gen/*.go", "internal/gen/sub/api.go", false},
+		{"/main.go", "main.go", true},
+		{"/main.go", "cmd/main.go", false},
+
+		// A glob matching a directory matches everything inside it. A trailing `/` does not anchor.
+		{"web/dist/", "web/dist", true},
+		{"web/dist/", "web/dist/", true},
+		{"web/dist/", "web/dist/js/app.js", true},
+		{"web/dist/", "web/distx/app.js", false},
+		{"node_modules/", "web/node_modules/react/index.js", true},
+		{"node_modules", "node_modules/react/index.js", true},
+
+		// Character classes.
+		{"[abc].go", "b.go", true},
+		{"[abc].go", "d.go", false},
+		{"[!abc].go", "d.go", true},
+		{"[!abc].go", "a.go", false},
+		{"v[0-9].txt", "v7.txt", true},
+		{"v[0-9].txt", "vx.txt", false},
+
+		// Escapes and regex metacharacters are taken literally.
+		{`\*.go`, "*.go", true},
+		{`\*.go`, "main.go", false},
+		{"a+b.go", "a+b.go", true},
+		{"a+b.go", "aab.go", false},
+		{"(x).go", "(x).go", true},
+	}
+
+	for _, test := range tests {
+		re, err := GlobToRegexp(test.glob)
+		if err != nil {
+			t.Errorf("GlobToRegexp(%q): %v", test.glob, err)
+			continue
+		}
+
+		if got := re.MatchString(test.path); got != test.matches {
+			t.Errorf("GlobToRegexp(%q) = %s, matching %q = %t, want %t", test.glob, re, test.path, got, test.matches)
+		}
+	}
+}
+
+func TestGlobToRegexpUnterminatedClass(t *testing.T) {
+	if _, err := GlobToRegexp("[abc.go"); err == nil {
+		t.Error("GlobToRegexp accepted an unterminated character class")
+	}
+}
+
+func newTestMatcher(t *testing.T, ignore []string, ignoreGlobs []string, include []string) (*Matcher, string) {
+	t.Helper()
+
+	m, err := NewMatcher(ignore, ignoreGlobs, include, false)
+	if err != nil {
+		t.Fatalf("NewMatcher: %v", err)
+	}
+
+	root := t.TempDir()
+	m.AddRoot(root)
+	return m, root
+}
+
+func TestMatcherMatch(t *testing.T) {
+	m, root := newTestMatcher(t,
+		[]string{"~$", "^web/dist/", "_test\\.go$"},
+		[]string{"internal/gen/*.go", "tmp/"},
+		nil,
+	)
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		matches bool
+	}{
+		{"main.go", false, true},
+		{"pkg/util.go", false, true},
+		// Regexes match the name.
+		{"main.go~", false, false},
+		{"pkg/util_test.go", false, false},
+		// And the relative path, where directories have a trailing slash.
+		{"web/dist/app.js", false, false},
+		{"web/dist", true, false},
+		{"web/dist", false, true},
+		{"other/web/dist/app.js", false, true},
+		// Globs.
+		{"internal/gen/api.go", false, false},
+		{"internal/gen/sub/api.go", false, true},
+		{"tmp/out.txt", false, false},
+		{"pkg/tmp/out.txt", false, false},
+	}
+
+	for _, test := range tests {
+		if got := m.Match(filepath.Join(root, test.path), test.isDir); got != test.matches {
+			t.Errorf("Match(%q, %t) = %t, want %t", test.path, test.isDir, got, test.matches)
+		}
+	}
+
+	if m.Match(filepath.Join(t.TempDir(), "main.go"), false) {
+		t.Error("Matched a path outside every root")
+	}
+
+	// fanotify without CAP_DAC_READ_SEARCH only reports names, which are matched as they are.
+	if !m.Match("main.go", false) || m.Match("main.go~", false) {
+		t.Error("Bare names are not matched as relative paths")
+	}
+}
+
+func TestMatcherSkipDir(t *testing.T) {
+	m, root := newTestMatcher(t, []string{"^web/dist/", "^\\.cache$"}, []string{"**/node_modules/"}, []string{"**/*.go"})
+
+	tests := []struct {
+		dir  string
+		skip bool
+	}{
+		{".", false},
+		{"pkg", false},
+		{"web/dist", true},
+		{"web", false},
+		{".cache", true},
+		{"node_modules", true},
+		{"web/node_modules", true},
+		// Include globs limit what is reported, not what is watched.
+		{"docs", false},
+	}
+
+	for _, test := range tests {
+		if got := m.SkipDir(filepath.Join(root, test.dir)); got != test.skip {
+			t.Errorf("SkipDir(%q) = %t, want %t", test.dir, got, test.skip)
+		}
+	}
+
+	if !m.SkipDir(t.TempDir()) {
+		t.Error("A directory outside every root is not skipped")
+	}
+}
+
+func TestMatcherInclude(t *testing.T) {
+	m, root := newTestMatcher(t, []string{"_test\\.go$"}, nil, []string{"**/*.go", "web/**/*.tmpl", "go.mod"})
+
+	tests := []struct {
+		path    string
+		matches bool
+	}{
+		{"main.go", true},
+		{"cmd/kjor/main.go", true},
+		{"go.mod", true},
+		{"web/pages/index.tmpl", true},
+		{"other/index.tmpl", false},
+		{"README.md", false},
+		{"sub/go.mod", true},
+		// Ignores win over includes.
+		{"main_test.go", false},
+	}
+
+	for _, test := range tests {
+		if got := m.Match(filepath.Join(root, test.path), false); got != test.matches {
+			t.Errorf("Match(%q) = %t, want %t", test.path, got, test.matches)
+		}
+	}
+}
+
+func TestMatcherFileRoots(t *testing.T) {
+	m, err := NewMatcher([]string{"\\.conf$"}, nil, []string{"**/*.go"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.conf")
+	m.AddFile(file)
+
+	// A single file is always reported, whatever the ignores and includes say.
+	if !m.Match(file, false) {
+		t.Error("The file root is not matched")
+	}
+	if m.Match(filepath.Join(dir, "other.go"), false) {
+		t.Error("A file next to the file root is matched")
+	}
+	if !m.Covers(dir) {
+		t.Error("The directory of the file root is not covered")
+	}
+
+	m.Remove(file)
+	if m.Match(file, false) || m.Covers(dir) {
+		t.Error("The file root is still matched after Remove")
+	}
+}
+
+func TestMatcherNestedRoots(t *testing.T) {
+	m, err := NewMatcher([]string{"^gen/"}, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outer := t.TempDir()
+	inner := filepath.Join(outer, "lib")
+	m.AddRoot(outer)
+	m.AddRoot(inner)
+
+	// Paths are relative to the closest root.
+	if m.Match(filepath.Join(inner, "gen", "api.go"), false) {
+		t.Error("lib/gen is not ignored relative to the lib root")
+	}
+	if !m.Match(filepath.Join(outer, "lib2", "gen", "api.go"), false) {
+		t.Error("lib2/gen is ignored")
+	}
+}
+
+func TestMatcherIgnorePath(t *testing.T) {
+	m, root := newTestMatcher(t, nil, nil, nil)
+	output := filepath.Join(root, "server")
+	tmpOutput := filepath.Join(root, ".server.kjor-tmp")
+	m.IgnorePath(output, false)
+	m.IgnorePath(tmpOutput, true)
+
+	tests := []struct {
+		path    string
+		matches bool
+	}{
+		{output, false},
+		{tmpOutput, false},
+		// go build probes the umask with a file next to its output.
+		{tmpOutput + "-go-tmp-umask", false},
+		{filepath.Join(root, "server.go"), true},
+		{filepath.Join(root, "cmd", "server"), true},
+		{filepath.Join(root, "cmd", ".server.kjor-tmp"), true},
+		// Bare names are compared with the names of the ignored paths.
+		{"server", false},
+		{".server.kjor-tmp-go-tmp-umask", false},
+		{"server.go", true},
+	}
+
+	for _, test := range tests {
+		if got := m.Match(test.path, false); got != test.matches {
+			t.Errorf("Match(%q) = %t, want %t", test.path, got, test.matches)
+		}
+	}
+
+	// Ignoring a path wins over watching it as a single file.
+	m.AddFile(output)
+	if m.Match(output, false) {
+		t.Error("An ignored file root is matched")
+	}
+}
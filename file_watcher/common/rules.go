@@ -0,0 +1,96 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Action is what a change to a file requires. Actions are ordered by strength, so a batch of
+// changes only needs the strongest action of its files.
+type Action int
+
+const (
+	ActionIgnore Action = iota
+	ActionCSSInject
+	ActionBrowserReload
+	ActionRunCommand
+	ActionRestartOnly
+	ActionRebuild
+)
+
+var actionNames = map[Action]string{
+	ActionIgnore:        "ignore",
+	ActionCSSInject:     "css-inject",
+	ActionBrowserReload: "browser-reload",
+	ActionRunCommand:    "run-command",
+	ActionRestartOnly:   "restart-only",
+	ActionRebuild:       "rebuild",
+}
+
+func (a Action) String() string {
+	return actionNames[a]
+}
+
+func ParseAction(name string) (Action, error) {
+	for action, actionName := range actionNames {
+		if actionName == name {
+			return action, nil
+		}
+	}
+	return ActionIgnore, fmt.Errorf("Unknown rule action: [%s]", name)
+}
+
+// Rule maps paths matching any of its globs or regexes to an action. Command is only used by
+// ActionRunCommand.
+type Rule struct {
+	Action   Action
+	Command  []string
+	matchers []*regexp.Regexp
+}
+
+func NewRule(globs []string, regexes []string, action string, command []string) (*Rule, error) {
+	a, err := ParseAction(action)
+	if err != nil {
+		return nil, err
+	}
+
+	if a == ActionRunCommand && len(command) == 0 {
+		return nil, fmt.Errorf("Rule with action %s needs a Command", a)
+	}
+
+	rule := &Rule{Action: a, Command: command}
+	for _, glob := range globs {
+		re, err := GlobToRegexp(glob)
+		if err != nil {
+			return nil, err
+		}
+		rule.matchers = append(rule.matchers, re)
+	}
+
+	for _, r := range regexes {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to compile rule regex: [%v]", err)
+		}
+		rule.matchers = append(rule.matchers, re)
+	}
+
+	return rule, nil
+}
+
+// Match tells whether path, relative to the watch root and slash separated, is covered by the rule.
+func (r *Rule) Match(path string) bool {
+	return RegexpAny(r.matchers, path)
+}
+
+type Rules []*Rule
+
+// Match returns the first rule matching path, or nil if no rule does.
+func (rs Rules) Match(path string) *Rule {
+	for _, rule := range rs {
+		if rule.Match(path) {
+			return rule
+		}
+	}
+	return nil
+}
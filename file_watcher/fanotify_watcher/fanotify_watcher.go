@@ -1,6 +1,7 @@
 package fanotify_watcher
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/fs"
@@ -8,8 +9,10 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
 	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -39,38 +42,54 @@ func IsSupported() bool {
 type FaNotifyWatcher struct {
 	eventStream chan common.Event
 
-	ableToOpenFid    bool
-	eventReader      io.ReadCloser
-	eventTypes       uint
-	fanFd            int
-	ignoredFileNames []*regexp.Regexp
-	path             string
-	watchedDir       []string
-	logger           *slog.Logger
+	ableToOpenFid bool
+	eventReader   io.ReadCloser
+	eventTypes    uint
+	fanFd         int
+	matcher       *common.Matcher
+	path          string
+	mu            sync.Mutex
+	watchedDir    []string
+	watched       atomic.Int64
+	logger        *slog.Logger
 }
 
 func NewFaNotifyWatcher(c *config.Config, logger *slog.Logger) (*FaNotifyWatcher, error) {
-	fw := &FaNotifyWatcher{
-		eventStream:      make(chan common.Event, 30),
-		eventTypes:       ALL,
-		ableToOpenFid:    CapabilityDacReadSearch(),
-		watchedDir:       make([]string, 0),
-		ignoredFileNames: make([]*regexp.Regexp, 0),
-		logger:           logger,
+	fwc := c.Filewatcher
+	matcher, err := common.NewMatcher(fwc.Ignore, fwc.IgnoreGlob, fwc.Include, fwc.UseGitignore)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, r := range c.Filewatcher.Ignore {
-		re, err := regexp.Compile(r)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to compile an ignore file regex: [%v]", err)
-		}
-		fw.ignoredFileNames = append(fw.ignoredFileNames, re)
+	fw := &FaNotifyWatcher{
+		eventStream:   make(chan common.Event, 30),
+		eventTypes:    ALL,
+		ableToOpenFid: CapabilityDacReadSearch(),
+		watchedDir:    make([]string, 0),
+		matcher:       matcher,
+		logger:        logger,
 	}
 
 	return fw, fw.initialize()
 }
 
+// Watch adds a directory, with everything below it, or a single file. A single file is watched
+// through its directory, as fanotify only marks directories here.
 func (fw *FaNotifyWatcher) Watch(dirPath string) error {
+	fi, err := os.Stat(dirPath)
+	if err != nil {
+		return fmt.Errorf("Unable to add dirPath %s: [%v]", dirPath, err)
+	}
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if !fi.IsDir() {
+		fw.matcher.AddFile(dirPath)
+		return fw.addDirToNotifyGroup(filepath.Dir(dirPath))
+	}
+
+	fw.matcher.AddRoot(dirPath)
 	if err := fw.watchSubDirectories(dirPath); err != nil {
 		return fmt.Errorf("Unable to add dirPath %s: [%v]", dirPath, err)
 	}
@@ -78,13 +97,55 @@ func (fw *FaNotifyWatcher) Watch(dirPath string) error {
 	return nil
 }
 
+// Unwatch removes a path added with Watch. Directories that are still covered by another root
+// stay watched.
+func (fw *FaNotifyWatcher) Unwatch(dirPath string) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.matcher.Remove(dirPath)
+	kept := make([]string, 0, len(fw.watchedDir))
+	for _, dir := range fw.watchedDir {
+		if fw.matcher.Covers(dir) {
+			kept = append(kept, dir)
+			continue
+		}
+
+		// Fails if the directory is already gone, which removes the mark as well.
+		unix.FanotifyMark(
+			fw.fanFd,
+			unix.FAN_MARK_REMOVE|unix.FAN_MARK_ONLYDIR,
+			uint64(fw.eventTypes|unix.FAN_EVENT_ON_CHILD|unix.FAN_ONDIR),
+			unix.AT_FDCWD,
+			dir,
+		)
+	}
+	fw.watchedDir = kept
+	fw.watched.Store(int64(len(fw.watchedDir)))
+	return nil
+}
+
+// Ignore stops changes to the file at path, or with prefix the files starting with it, from
+// being reported.
+func (fw *FaNotifyWatcher) Ignore(path string, prefix bool) {
+	fw.matcher.IgnorePath(path, prefix)
+}
+
+func (fw *FaNotifyWatcher) WatchedDirs() int {
+	return int(fw.watched.Load())
+}
+
 func (fw *FaNotifyWatcher) EventStream() chan common.Event {
 	return fw.eventStream
 }
 
+// Close closes the fanotify descriptor. fanFd is owned by eventReader, so it is closed through it.
+// It takes mu, as reInitialize replaces eventReader while Start may be closing it from another
+// goroutine.
 func (fw *FaNotifyWatcher) Close() error {
-	fw.eventReader.Close()
-	return unix.Close(fw.fanFd)
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return fw.eventReader.Close()
 }
 
 func (fw *FaNotifyWatcher) addDirToNotifyGroup(dirPath string) error {
@@ -92,6 +153,9 @@ func (fw *FaNotifyWatcher) addDirToNotifyGroup(dirPath string) error {
 	// "If pathname is NULL, and dirfd takes the special value AT_FDCWD, the current working directory is to be marked."
 	// But I only get ERRNO EBADF when trying that. This is not exclusive to the Go Implementation as it seem to behave
 	// the same way in C. Marking The current directory is done with the string "."
+	if slices.Contains(fw.watchedDir, dirPath) {
+		return nil
+	}
 
 	err := unix.FanotifyMark(
 		fw.fanFd,
@@ -105,19 +169,35 @@ func (fw *FaNotifyWatcher) addDirToNotifyGroup(dirPath string) error {
 		return fmt.Errorf("Unable to watch path (%s): [%w]", dirPath, err)
 	} else {
 		fw.watchedDir = append(fw.watchedDir, dirPath)
+		fw.watched.Store(int64(len(fw.watchedDir)))
 		return err
 	}
 }
 
 func (fw *FaNotifyWatcher) reInitialize() error {
-	fw.Close()
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.eventReader.Close()
 	if err := fw.initialize(); err != nil {
 		return err
 	}
 
-	for _, dir := range fw.watchedDir {
-		if err := fw.Watch(dir); err != nil {
-			fw.logger.Warn("Failed to watch directory", "dir", dir)
+	// The directories are walked again, so that the new directory that made the queue overflow is
+	// watched as well. addDirToNotifyGroup adds them back to watchedDir, skipping the ones that
+	// have been seen already. Directories only holding a single file root are not walked.
+	dirs := fw.watchedDir
+	fw.watchedDir = make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		var err error
+		if fw.matcher.SkipDir(dir) {
+			err = fw.addDirToNotifyGroup(dir)
+		} else {
+			err = fw.watchSubDirectories(dir)
+		}
+
+		if err != nil {
+			fw.logger.Warn("Failed to watch directory", "dir", dir, "err", err)
 		}
 	}
 
@@ -126,7 +206,7 @@ func (fw *FaNotifyWatcher) reInitialize() error {
 
 func (fw *FaNotifyWatcher) initialize() error {
 	fd, err := unix.FanotifyInit(
-		unix.FAN_CLASS_NOTIF|unix.FAN_REPORT_FID|unix.FAN_REPORT_DIR_FID|unix.FAN_REPORT_DFID_NAME,
+		unix.FAN_CLASS_NOTIF|unix.FAN_REPORT_FID|unix.FAN_REPORT_DIR_FID|unix.FAN_REPORT_DFID_NAME|unix.FAN_NONBLOCK|unix.FAN_CLOEXEC,
 		unix.O_RDONLY|unix.O_LARGEFILE,
 	)
 
@@ -148,7 +228,11 @@ func (fw *FaNotifyWatcher) initialize() error {
 
 func (fw *FaNotifyWatcher) watchSubDirectories(dirPath string) error {
 	return filepath.WalkDir(dirPath, func(cPath string, d fs.DirEntry, err error) error {
-		// Note: Random segfault after delete and mkdir. Is WalkDir cached so deleted dir still exist?
+		// A directory deleted while walking is reported with an error, and without d for the root.
+		if err != nil {
+			return nil
+		}
+
 		if d.IsDir() {
 			runeName := []rune(d.Name())
 			if len(runeName) > 2 && runeName[0] == '.' && runeName[1] != '/' {
@@ -156,6 +240,10 @@ func (fw *FaNotifyWatcher) watchSubDirectories(dirPath string) error {
 				return fs.SkipDir
 			}
 
+			if fw.matcher.SkipDir(cPath) {
+				return fs.SkipDir
+			}
+
 			return fw.addDirToNotifyGroup(cPath)
 		}
 
@@ -163,7 +251,13 @@ func (fw *FaNotifyWatcher) watchSubDirectories(dirPath string) error {
 	})
 }
 
-func (fw *FaNotifyWatcher) Start() error {
+// Start reads events until ctx is cancelled or reading fails. The event stream is closed on return.
+func (fw *FaNotifyWatcher) Start(ctx context.Context) error {
+	defer close(fw.eventStream)
+	// reInitialize replaces eventReader, so close whichever reader is current when ctx is done.
+	stop := context.AfterFunc(ctx, func() { fw.Close() })
+	defer stop()
+
 	for {
 		buf := make([]byte, 4096)
 
@@ -171,6 +265,9 @@ func (fw *FaNotifyWatcher) Start() error {
 		for {
 			n, err := fw.eventReader.Read(buf)
 			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
 				return err
 			}
 
@@ -184,7 +281,6 @@ func (fw *FaNotifyWatcher) Start() error {
 					break QueueWatcher
 				}
 
-				fileName := ""
 				fullName := ""
 
 				var hdr *FanotifyEventInfoHeader
@@ -210,7 +306,6 @@ func (fw *FaNotifyWatcher) Start() error {
 						if len(fullName) == 0 {
 							fullName = path.Join(ei.HandleAsString(), ei.Name())
 						}
-						fileName = ei.Name()
 					case len(fullName) == 0 && (ei.Hdr.InfoType&unix.FAN_EVENT_INFO_TYPE_FID) != 0 && (ei.Hdr.InfoType&unix.FAN_EVENT_INFO_TYPE_DFID) != 0:
 						fullName = ei.HandleAsString()
 					}
@@ -218,13 +313,24 @@ func (fw *FaNotifyWatcher) Start() error {
 					fw.logger.Debug("Inbound EventInfo", "EvendInfo", ei, "Type", ei.Hdr.InfoTypeToString(), "Handle", ei.HandleAsString())
 				}
 
-				if !common.RegexpAny(fw.ignoredFileNames, fileName) {
-					fw.eventStream <- common.Event{FileName: fullName, Type: event.Mask, When: time.Now()}
+				// Without CAP_DAC_READ_SEARCH fullName is only a name, which is matched as it is.
+				fw.matcher.Changed(fullName)
+
+				isDir := (event.Mask & unix.FAN_ONDIR) != 0
+				if fw.matcher.Match(fullName, isDir) {
+					select {
+					case fw.eventStream <- common.Event{FileName: fullName, Type: event.Mask, When: time.Now()}:
+					case <-ctx.Done():
+						return nil
+					}
 				}
 				idx += event.Event_len
 			}
 		}
 		fw.logger.Warn("ReInitializing FaNotifyWatcher")
 		fw.reInitialize()
+		if ctx.Err() != nil {
+			return nil
+		}
 	}
 }
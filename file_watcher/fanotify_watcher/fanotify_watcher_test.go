@@ -0,0 +1,99 @@
+package fanotify_watcher
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/subfusc/kjor/config"
+)
+
+// Creating a directory makes the watcher reinitialize, which must watch the new directory too.
+func TestNewDirectoryIsWatched(t *testing.T) {
+	dir := t.TempDir()
+	fw, err := NewFaNotifyWatcher(config.DefaultConfig(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Skipf("fanotify is not available: %v", err)
+	}
+	if err := fw.Watch(dir); err != nil {
+		t.Skipf("fanotify is not available: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go fw.Start(ctx)
+
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fw.WatchedDirs() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Watching %d directories, want 2", fw.WatchedDirs())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	file := filepath.Join(sub, "main.go")
+	if err := os.WriteFile(file, []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-fw.EventStream():
+			if filepath.Base(event.FileName) == "main.go" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("No event for a file in the new directory")
+		}
+	}
+}
+
+// Cancelling while the watcher reinitializes must close the new descriptor, not only the old one.
+func TestStopWhileReinitializing(t *testing.T) {
+	dir := t.TempDir()
+	fw, err := NewFaNotifyWatcher(config.DefaultConfig(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Skipf("fanotify is not available: %v", err)
+	}
+	if err := fw.Watch(dir); err != nil {
+		t.Skipf("fanotify is not available: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() { stopped <- fw.Start(ctx) }()
+	go func() {
+		for range fw.EventStream() {
+		}
+	}()
+
+	for i := range 50 {
+		if err := os.Mkdir(filepath.Join(dir, fmt.Sprintf("sub%d", i)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if i == 25 {
+			cancel()
+		}
+	}
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Start: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after ctx was cancelled")
+	}
+}
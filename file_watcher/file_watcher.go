@@ -1,18 +1,31 @@
 package file_watcher
 
 import (
+	"context"
 	"log/slog"
 
 	"github.com/subfusc/kjor/config"
 	"github.com/subfusc/kjor/file_watcher/common"
 	"github.com/subfusc/kjor/file_watcher/fanotify_watcher"
 	"github.com/subfusc/kjor/file_watcher/inotify_watcher"
+	"github.com/subfusc/kjor/file_watcher/poll_watcher"
 )
 type FileWatcher interface {
 	Close() error
 	EventStream() chan common.Event
-	Start() error
+	Start(ctx context.Context) error
+	// Watch adds a directory, with everything below it, or a single file. It can be called while
+	// the watcher is running.
 	Watch(path string) error
+	// Unwatch removes a path added with Watch.
+	Unwatch(path string) error
+	// Ignore makes changes to the file at the absolute path never be reported, like the build
+	// output. With prefix, the files next to it starting with its name are not reported either.
+	// It can be called while the watcher is running.
+	Ignore(path string, prefix bool)
+	// WatchedDirs returns the number of directories being watched. It is safe to call while
+	// the watcher is running.
+	WatchedDirs() int
 }
 
 func NewFileWatcher(c *config.Config, logger *slog.Logger) (FileWatcher, error) {
@@ -21,6 +34,8 @@ func NewFileWatcher(c *config.Config, logger *slog.Logger) (FileWatcher, error)
 		return fanotify_watcher.NewFaNotifyWatcher(c, logger)
 	case "inotify":
 		return inotify_watcher.NewInotifyWatcher(c, logger)
+	case "poll":
+		return poll_watcher.NewPollWatcher(c, logger)
 	default:
 		slog.Info("FileWatch backend not configured, using Inotify as fallback")
 		return inotify_watcher.NewInotifyWatcher(c, logger)
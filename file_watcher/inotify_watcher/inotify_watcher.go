@@ -2,13 +2,16 @@ package inotify_watcher
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
-	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -51,30 +54,32 @@ type InotifyWatcher struct {
 	externalEventStream chan common.Event
 	inotifyFD           int
 	eventStream         io.ReadCloser
+	mu                  sync.Mutex
 	pathToWD            map[string]int
-	wdToPath            []string
-	ignoreFiles         []*regexp.Regexp
+	wdToPath            map[int]string
+	moves               map[uint32]string
+	watched             atomic.Int64
+	matcher             *common.Matcher
 	logger              *slog.Logger
 }
 
 var sizeOfInotifyEvent = uint32(unsafe.Sizeof(InotifyEvent{}))
 
 func NewInotifyWatcher(c *config.Config, logger *slog.Logger) (*InotifyWatcher, error) {
-	fd, err := unix.InotifyInit()
+	// Non-blocking so that the descriptor is handled by the runtime poller, which lets Close
+	// interrupt a pending Read.
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to open an Inotify descriptor: [%v]", err)
 	}
 
 	es := os.NewFile(uintptr(fd), "")
 
-	ignores := make([]*regexp.Regexp, 0)
-	for _, ire := range c.Filewatcher.Ignore {
-		re, err := regexp.Compile(ire)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to compile an IgnoreFile re: [%v]", err)
-		}
-
-		ignores = append(ignores, re)
+	fwc := c.Filewatcher
+	matcher, err := common.NewMatcher(fwc.Ignore, fwc.IgnoreGlob, fwc.Include, fwc.UseGitignore)
+	if err != nil {
+		es.Close()
+		return nil, err
 	}
 
 	return &InotifyWatcher{
@@ -82,8 +87,9 @@ func NewInotifyWatcher(c *config.Config, logger *slog.Logger) (*InotifyWatcher,
 		inotifyFD:           fd,
 		eventStream:         es,
 		pathToWD:            make(map[string]int),
-		wdToPath:            make([]string, 0),
-		ignoreFiles:         ignores,
+		wdToPath:            make(map[int]string),
+		moves:               make(map[uint32]string),
+		matcher:             matcher,
 		logger:              logger,
 	}, nil
 }
@@ -98,14 +104,104 @@ func (iw *InotifyWatcher) watch(dirPath string) error {
 		return fmt.Errorf("Unable to add Watch: [%v]", err)
 	}
 	iw.pathToWD[dirPath] = wd
-	iw.wdToPath = append(iw.wdToPath, dirPath)
+	iw.wdToPath[wd] = dirPath
+	iw.watched.Add(1)
 	return nil
 }
 
+func (iw *InotifyWatcher) unwatch(dirPath string) {
+	wd, ok := iw.pathToWD[dirPath]
+	if !ok {
+		return
+	}
+
+	// Fails if the directory is already gone, which removes the watch as well.
+	unix.InotifyRmWatch(iw.inotifyFD, uint32(wd))
+	delete(iw.pathToWD, dirPath)
+	delete(iw.wdToPath, wd)
+	iw.watched.Add(-1)
+}
+
+// below returns the watched directories that are dirPath or inside it.
+func (iw *InotifyWatcher) below(dirPath string) []string {
+	dirs := make([]string, 0)
+	for p := range iw.pathToWD {
+		if p == dirPath || strings.HasPrefix(p, dirPath+string(filepath.Separator)) {
+			dirs = append(dirs, p)
+		}
+	}
+	return dirs
+}
+
+func (iw *InotifyWatcher) unwatchTree(dirPath string) {
+	for _, p := range iw.below(dirPath) {
+		iw.unwatch(p)
+	}
+}
+
+// renameTree moves the watches of oldPath and everything inside it to newPath. The watches
+// follow the directories, so only the paths need to change.
+func (iw *InotifyWatcher) renameTree(oldPath string, newPath string) {
+	for _, p := range iw.below(oldPath) {
+		wd := iw.pathToWD[p]
+		moved := newPath + strings.TrimPrefix(p, oldPath)
+		delete(iw.pathToWD, p)
+		iw.pathToWD[moved] = wd
+		iw.wdToPath[wd] = moved
+	}
+}
+
+// movedTo handles a directory moved to dirPath. oldPath is where it came from, or "" when it
+// came from outside the watched directories.
+func (iw *InotifyWatcher) movedTo(oldPath string, dirPath string) {
+	if oldPath != "" {
+		iw.renameTree(oldPath, dirPath)
+	}
+
+	// The new place decides whether the directory is watched at all.
+	if []rune(filepath.Base(dirPath))[0] == '.' || iw.matcher.SkipDir(dirPath) {
+		iw.unwatchTree(dirPath)
+		return
+	}
+
+	if iw.pathToWD[dirPath] == 0 {
+		if err := iw.watchTraverse(dirPath); err != nil {
+			iw.logger.Warn("Failed to watch moved directory", "path", dirPath, "err", err)
+		}
+	}
+}
+
+// moveWait is how long, in milliseconds, the other half of a move from the end of a read is
+// waited for.
+const moveWait = 10
+
+// settleMoves stops watching the directories moved away without a matching IN_MOVED_TO, which
+// means that they left the watched directories. The kernel queues both halves of a move next to
+// each other, so only a move from the end of a read can still be waiting for its other half, and
+// only if more events are on their way.
+func (iw *InotifyWatcher) settleMoves(waiting uint32) {
+	if waiting != 0 {
+		fds := []unix.PollFd{{Fd: int32(iw.inotifyFD), Events: unix.POLLIN}}
+		if n, err := unix.Poll(fds, moveWait); err != nil || n == 0 {
+			waiting = 0
+		}
+	}
+
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+
+	for cookie, p := range iw.moves {
+		if cookie != waiting {
+			iw.unwatchTree(p)
+			delete(iw.moves, cookie)
+		}
+	}
+}
+
 func (iw *InotifyWatcher) watchTraverse(dirPath string) error {
 	err := filepath.WalkDir(dirPath, func(p string, d os.DirEntry, e error) error {
 		if d.IsDir() {
-			if []rune(d.Name())[0] == '.' || iw.pathToWD[p] != 0 {
+			if []rune(d.Name())[0] == '.' || iw.pathToWD[p] != 0 || iw.matcher.SkipDir(p) {
 				return fs.SkipDir
 			}
 
@@ -120,8 +216,49 @@ func (iw *InotifyWatcher) watchTraverse(dirPath string) error {
 	return nil
 }
 
-func (iw *InotifyWatcher) Watch(dirPath string) error {
-	return iw.watchTraverse(dirPath)
+// Watch adds a directory, with everything below it, or a single file. A single file is watched
+// through its directory, so that it is still seen when an editor replaces it.
+func (iw *InotifyWatcher) Watch(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("Unable to watch %s: [%v]", path, err)
+	}
+
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+
+	if !fi.IsDir() {
+		iw.matcher.AddFile(path)
+		return iw.watch(filepath.Dir(path))
+	}
+
+	iw.matcher.AddRoot(path)
+	return iw.watchTraverse(path)
+}
+
+// Unwatch removes a path added with Watch. Directories that are still covered by another root
+// stay watched.
+func (iw *InotifyWatcher) Unwatch(path string) error {
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+
+	iw.matcher.Remove(path)
+	for dir := range iw.pathToWD {
+		if !iw.matcher.Covers(dir) {
+			iw.unwatch(dir)
+		}
+	}
+	return nil
+}
+
+// Ignore stops changes to the file at path, or with prefix the files starting with it, from
+// being reported.
+func (iw *InotifyWatcher) Ignore(path string, prefix bool) {
+	iw.matcher.IgnorePath(path, prefix)
+}
+
+func (iw *InotifyWatcher) WatchedDirs() int {
+	return int(iw.watched.Load())
 }
 
 func (iw *InotifyWatcher) Close() error {
@@ -132,17 +269,26 @@ func (iw *InotifyWatcher) EventStream() chan common.Event {
 	return iw.externalEventStream
 }
 
-func (iw *InotifyWatcher) Start() error {
+// Start reads events until ctx is cancelled or reading fails. The event stream is closed on return.
+func (iw *InotifyWatcher) Start(ctx context.Context) error {
+	defer close(iw.externalEventStream)
+	stop := context.AfterFunc(ctx, func() { iw.Close() })
+	defer stop()
+
 	buf := make([]byte, 4096)
 
 	for {
 		i, err := iw.eventStream.Read(buf)
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
 			return err
 		}
 
 		un := uint32(0)
 		ui := uint32(i)
+		waiting := uint32(0)
 		for un < ui {
 			event := (*InotifyEvent)(unsafe.Pointer(&buf[un]))
 			name := bytes.NewBuffer(nil)
@@ -152,26 +298,60 @@ func (iw *InotifyWatcher) Start() error {
 				}
 			}
 
-			fullPath := filepath.Join(iw.wdToPath[event.Wd-1], name.String())
+			iw.mu.Lock()
+			dir, ok := iw.wdToPath[int(event.Wd)]
+			if !ok {
+				// Events still queued for a watch that has been removed.
+				iw.mu.Unlock()
+				un += sizeOfInotifyEvent + event.Len
+				continue
+			}
+
+			fullPath := filepath.Join(dir, name.String())
+			waiting = 0
+			if (event.Mask&unix.IN_MOVED_FROM) != 0 && (event.Mask&unix.IN_ISDIR) != 0 {
+				iw.moves[event.Cookie] = fullPath
+				waiting = event.Cookie
+			}
+
+			if (event.Mask&unix.IN_MOVED_TO) != 0 && (event.Mask&unix.IN_ISDIR) != 0 {
+				oldPath := iw.moves[event.Cookie]
+				delete(iw.moves, event.Cookie)
+				iw.movedTo(oldPath, fullPath)
+			}
+
 			if (event.Mask & unix.IN_CREATE) != 0 {
 				if fi, err := os.Stat(fullPath); err != nil {
 					iw.logger.Warn("Failed to stat file", "path", fullPath, "err", err)
 				} else if fi.IsDir() && []rune(name.String())[0] != '.' && iw.pathToWD[fullPath] == 0 {
-					iw.Watch(fullPath)
+					iw.watchTraverse(fullPath)
 				}
 			}
 
 			if (event.Mask & unix.IN_DELETE_SELF) != 0 {
-				// As long  as wd is allways increasing it is not necessary to delete the corresponding wdToPath
-				// unless something really unexpected is going on
-				delete(iw.pathToWD, fullPath)
+				// The kernel has removed the watch already, and the IN_IGNORED that follows is dropped.
+				if _, ok := iw.pathToWD[fullPath]; ok {
+					delete(iw.pathToWD, fullPath)
+					delete(iw.wdToPath, int(event.Wd))
+					iw.watched.Add(-1)
+				}
 			}
+			iw.mu.Unlock()
 
-			if !common.RegexpAny(iw.ignoreFiles, name.String()) {
-				iw.externalEventStream <- common.Event{FileName: fullPath, Type: uint64(event.Mask), When: time.Now()}
+			iw.matcher.Changed(fullPath)
+
+			isDir := (event.Mask & unix.IN_ISDIR) != 0
+			if iw.matcher.Match(fullPath, isDir) {
+				select {
+				case iw.externalEventStream <- common.Event{FileName: fullPath, Type: uint64(event.Mask), When: time.Now()}:
+				case <-ctx.Done():
+					return nil
+				}
 			}
 
 			un += sizeOfInotifyEvent + event.Len
 		}
+
+		iw.settleMoves(waiting)
 	}
 }
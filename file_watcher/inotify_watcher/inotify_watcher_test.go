@@ -0,0 +1,188 @@
+package inotify_watcher
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/subfusc/kjor/config"
+)
+
+func mkdirAll(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func rename(t *testing.T, from string, to string) {
+	t.Helper()
+	if err := os.Rename(from, to); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startWatcher watches root, which must exist, until the test ends.
+func startWatcher(t *testing.T, c *config.Config, root string) *InotifyWatcher {
+	t.Helper()
+
+	iw, err := NewInotifyWatcher(c, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("NewInotifyWatcher: %v", err)
+	}
+	if err := iw.Watch(root); err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go iw.Start(ctx)
+	return iw
+}
+
+func waitForWatched(t *testing.T, iw *InotifyWatcher, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for iw.WatchedDirs() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Watching %d directories, want %d", iw.WatchedDirs(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// expectEvent reads events until one for path arrives.
+func expectEvent(t *testing.T, iw *InotifyWatcher, path string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-iw.EventStream():
+			if event.FileName == path {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("No event for %s", path)
+		}
+	}
+}
+
+// expectNoEvent fails if an event for path arrives within a short while.
+func expectNoEvent(t *testing.T, iw *InotifyWatcher, path string) {
+	t.Helper()
+	timeout := time.After(200 * time.Millisecond)
+	for {
+		select {
+		case event := <-iw.EventStream():
+			if event.FileName == path {
+				t.Fatalf("Got an event for %s", path)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func TestRenameWithinTree(t *testing.T) {
+	root := t.TempDir()
+	mkdirAll(t, filepath.Join(root, "a", "b", "c"))
+	iw := startWatcher(t, config.DefaultConfig(), root)
+	waitForWatched(t, iw, 4)
+
+	rename(t, filepath.Join(root, "a"), filepath.Join(root, "renamed"))
+	expectEvent(t, iw, filepath.Join(root, "renamed"))
+
+	// The watches of the descendants follow, and report the new paths.
+	for _, dir := range []string{"renamed", "renamed/b", "renamed/b/c"} {
+		file := filepath.Join(root, dir, "main.go")
+		writeFile(t, file)
+		expectEvent(t, iw, file)
+	}
+	waitForWatched(t, iw, 4)
+
+	// The old paths are free to be used again.
+	mkdirAll(t, filepath.Join(root, "a", "b"))
+	waitForWatched(t, iw, 6)
+	file := filepath.Join(root, "a", "b", "main.go")
+	writeFile(t, file)
+	expectEvent(t, iw, file)
+}
+
+func TestMoveInFromOutside(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	mkdirAll(t, filepath.Join(outside, "pkg", "sub"))
+	iw := startWatcher(t, config.DefaultConfig(), root)
+	waitForWatched(t, iw, 1)
+
+	rename(t, filepath.Join(outside, "pkg"), filepath.Join(root, "pkg"))
+	waitForWatched(t, iw, 3)
+
+	file := filepath.Join(root, "pkg", "sub", "main.go")
+	writeFile(t, file)
+	expectEvent(t, iw, file)
+}
+
+func TestMoveOutToOutside(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	mkdirAll(t, filepath.Join(root, "pkg", "sub"))
+	iw := startWatcher(t, config.DefaultConfig(), root)
+	waitForWatched(t, iw, 3)
+
+	rename(t, filepath.Join(root, "pkg"), filepath.Join(outside, "pkg"))
+	expectEvent(t, iw, filepath.Join(root, "pkg"))
+	waitForWatched(t, iw, 1)
+
+	file := filepath.Join(outside, "pkg", "sub", "main.go")
+	writeFile(t, file)
+	expectNoEvent(t, iw, file)
+	expectNoEvent(t, iw, filepath.Join(root, "pkg", "sub", "main.go"))
+}
+
+func TestMoveIntoIgnoredDirectory(t *testing.T) {
+	c := config.DefaultConfig()
+	c.Filewatcher.IgnoreGlob = []string{"build/"}
+
+	root := t.TempDir()
+	mkdirAll(t, filepath.Join(root, "pkg", "sub"))
+	mkdirAll(t, filepath.Join(root, "build"))
+	iw := startWatcher(t, c, root)
+	waitForWatched(t, iw, 3)
+
+	rename(t, filepath.Join(root, "pkg"), filepath.Join(root, "build", "pkg"))
+	waitForWatched(t, iw, 1)
+
+	file := filepath.Join(root, "build", "pkg", "sub", "main.go")
+	writeFile(t, file)
+	expectNoEvent(t, iw, file)
+
+	// Moving it back watches it again.
+	rename(t, filepath.Join(root, "build", "pkg"), filepath.Join(root, "pkg"))
+	waitForWatched(t, iw, 3)
+
+	file = filepath.Join(root, "pkg", "sub", "main.go")
+	writeFile(t, file)
+	expectEvent(t, iw, file)
+}
+
+func TestMoveIntoHiddenDirectory(t *testing.T) {
+	root := t.TempDir()
+	mkdirAll(t, filepath.Join(root, "pkg", "sub"))
+	iw := startWatcher(t, config.DefaultConfig(), root)
+	waitForWatched(t, iw, 3)
+
+	rename(t, filepath.Join(root, "pkg"), filepath.Join(root, ".pkg"))
+	waitForWatched(t, iw, 1)
+}
@@ -0,0 +1,254 @@
+package poll_watcher
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/subfusc/kjor/config"
+	"github.com/subfusc/kjor/file_watcher/common"
+	"golang.org/x/sys/unix"
+)
+
+const defaultInterval = 500
+
+// fileState is what a file is compared on between two scans.
+type fileState struct {
+	modTime time.Time
+	size    int64
+	inode   uint64
+	dir     bool
+}
+
+// PollWatcher finds changes by walking the watched trees at a fixed interval and comparing them
+// with the previous walk. It works where inotify and fanotify do not, like on network file
+// systems and the bind mounts of some container runtimes, at the cost of latency and CPU.
+//
+// Events use the inotify masks IN_CREATE, IN_MODIFY and IN_DELETE.
+type PollWatcher struct {
+	eventStream chan common.Event
+	interval    time.Duration
+	matcher     *common.Matcher
+	mu          sync.Mutex
+	roots       []string
+	snapshot    map[string]fileState
+	closed      chan struct{}
+	closeOnce   sync.Once
+	logger      *slog.Logger
+}
+
+func NewPollWatcher(c *config.Config, logger *slog.Logger) (*PollWatcher, error) {
+	fwc := c.Filewatcher
+	matcher, err := common.NewMatcher(fwc.Ignore, fwc.IgnoreGlob, fwc.Include, fwc.UseGitignore)
+	if err != nil {
+		return nil, err
+	}
+
+	interval := c.Filewatcher.PollInterval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	return &PollWatcher{
+		eventStream: make(chan common.Event, 100),
+		interval:    time.Duration(interval) * time.Millisecond,
+		matcher:     matcher,
+		roots:       make([]string, 0),
+		snapshot:    make(map[string]fileState),
+		closed:      make(chan struct{}),
+		logger:      logger,
+	}, nil
+}
+
+// Watch adds dirPath, a directory or a single file, to what is scanned. Files that are already
+// there do not cause events.
+func (pw *PollWatcher) Watch(dirPath string) error {
+	fi, err := os.Stat(dirPath)
+	if err != nil {
+		return fmt.Errorf("Failed to traverse dirPath \"%s\": [%v]", dirPath, err)
+	}
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if fi.IsDir() {
+		pw.matcher.AddRoot(dirPath)
+	} else {
+		pw.matcher.AddFile(dirPath)
+	}
+
+	if err := pw.scan(dirPath, pw.snapshot); err != nil {
+		return fmt.Errorf("Failed to traverse dirPath \"%s\": [%v]", dirPath, err)
+	}
+	pw.roots = append(pw.roots, dirPath)
+	return nil
+}
+
+// Unwatch stops scanning a path added with Watch. Its files are forgotten without events.
+func (pw *PollWatcher) Unwatch(dirPath string) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	pw.matcher.Remove(dirPath)
+	pw.roots = slices.DeleteFunc(pw.roots, func(root string) bool { return root == dirPath })
+
+	for p, state := range pw.snapshot {
+		dir := p
+		if !state.dir {
+			dir = filepath.Dir(p)
+		}
+
+		if !pw.matcher.Covers(dir) {
+			delete(pw.snapshot, p)
+		}
+	}
+	return nil
+}
+
+// Ignore stops changes to the file at path, or with prefix the files starting with it, from
+// being reported.
+func (pw *PollWatcher) Ignore(path string, prefix bool) {
+	pw.matcher.IgnorePath(path, prefix)
+}
+
+func (pw *PollWatcher) WatchedDirs() int {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	dirs := 0
+	for _, state := range pw.snapshot {
+		if state.dir {
+			dirs++
+		}
+	}
+	return dirs
+}
+
+func (pw *PollWatcher) EventStream() chan common.Event {
+	return pw.eventStream
+}
+
+// Close stops a running Start.
+func (pw *PollWatcher) Close() error {
+	pw.closeOnce.Do(func() { close(pw.closed) })
+	return nil
+}
+
+// scan adds the state of every file and directory below root to snapshot, skipping hidden and
+// ignored directories and files that are not matched. Ignore files are always kept, so that
+// changes to them are seen.
+func (pw *PollWatcher) scan(root string, snapshot map[string]fileState) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files removed during the walk show up as deleted in the next one.
+			if p != root {
+				return nil
+			}
+			return err
+		}
+
+		if d.IsDir() && p != root && d.Name()[0] == '.' {
+			return fs.SkipDir
+		}
+
+		if d.IsDir() && pw.matcher.SkipDir(p) {
+			return fs.SkipDir
+		}
+
+		if !d.IsDir() && !pw.matcher.Match(p, false) && !pw.matcher.IsIgnoreFile(p) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		state := fileState{modTime: info.ModTime(), size: info.Size(), dir: d.IsDir()}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			state.inode = st.Ino
+		}
+		snapshot[p] = state
+		return nil
+	})
+}
+
+// poll scans all roots and returns the events for the differences to the previous scan.
+func (pw *PollWatcher) poll() []common.Event {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	snapshot := make(map[string]fileState, len(pw.snapshot))
+	for _, root := range pw.roots {
+		if err := pw.scan(root, snapshot); err != nil {
+			pw.logger.Warn("Failed to scan directory", "root", root, "err", err)
+		}
+	}
+
+	now := time.Now()
+	events := make([]common.Event, 0)
+	for p, state := range snapshot {
+		old, ok := pw.snapshot[p]
+		switch {
+		case state.dir:
+		case !ok:
+			events = append(events, common.Event{FileName: p, Type: unix.IN_CREATE, When: now})
+		case old != state:
+			events = append(events, common.Event{FileName: p, Type: unix.IN_MODIFY, When: now})
+		}
+	}
+
+	for p, old := range pw.snapshot {
+		if _, ok := snapshot[p]; !ok && !old.dir {
+			events = append(events, common.Event{FileName: p, Type: unix.IN_DELETE, When: now})
+		}
+	}
+
+	// Changed ignore files take effect from the next scan.
+	matched := make([]common.Event, 0, len(events))
+	for _, event := range events {
+		pw.matcher.Changed(event.FileName)
+		if pw.matcher.Match(event.FileName, false) {
+			matched = append(matched, event)
+		}
+	}
+
+	pw.snapshot = snapshot
+	return matched
+}
+
+// Start polls until ctx is cancelled or the watcher is closed. The event stream is closed on
+// return.
+func (pw *PollWatcher) Start(ctx context.Context) error {
+	defer close(pw.eventStream)
+
+	ticker := time.NewTicker(pw.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		case <-pw.closed:
+			return nil
+		}
+
+		for _, event := range pw.poll() {
+			select {
+			case pw.eventStream <- event:
+			case <-ctx.Done():
+				return nil
+			case <-pw.closed:
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package poll_watcher
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/subfusc/kjor/config"
+	"golang.org/x/sys/unix"
+)
+
+func newTestWatcher(t *testing.T, c *config.Config) (*PollWatcher, string) {
+	t.Helper()
+
+	pw, err := NewPollWatcher(c, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("NewPollWatcher: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := pw.Watch(dir); err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	return pw, dir
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type polled struct {
+	path string
+	mask uint64
+}
+
+// expectPoll polls once and compares the events, in any order, with want.
+func expectPoll(t *testing.T, pw *PollWatcher, want ...polled) {
+	t.Helper()
+
+	got := make([]polled, 0)
+	for _, event := range pw.poll() {
+		got = append(got, polled{event.FileName, event.Type})
+	}
+
+	byPath := func(a, b polled) int {
+		if a.path < b.path {
+			return -1
+		} else if a.path > b.path {
+			return 1
+		}
+		return 0
+	}
+	slices.SortFunc(got, byPath)
+	slices.SortFunc(want, byPath)
+	if !slices.Equal(got, want) {
+		t.Errorf("Got events %v, want %v", got, want)
+	}
+}
+
+func TestPollCreateModifyDelete(t *testing.T) {
+	pw, dir := newTestWatcher(t, config.DefaultConfig())
+	file := filepath.Join(dir, "main.go")
+	nested := filepath.Join(dir, "pkg", "util.go")
+
+	expectPoll(t, pw)
+
+	writeFile(t, file, "package main\n")
+	writeFile(t, nested, "package pkg\n")
+	expectPoll(t, pw, polled{file, unix.IN_CREATE}, polled{nested, unix.IN_CREATE})
+	expectPoll(t, pw)
+
+	t.Run("size", func(t *testing.T) {
+		writeFile(t, file, "package main\n\nfunc main() {}\n")
+		expectPoll(t, pw, polled{file, unix.IN_MODIFY})
+	})
+
+	t.Run("mtime", func(t *testing.T) {
+		later := time.Now().Add(time.Hour)
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+		expectPoll(t, pw, polled{file, unix.IN_MODIFY})
+	})
+
+	t.Run("inode", func(t *testing.T) {
+		// Replaced by a file with the same size and time, like an editor saving through a rename.
+		fi, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := os.ReadFile(file)
+		tmp := filepath.Join(dir, "main.go.tmp")
+		writeFile(t, tmp, string(content))
+		os.Chtimes(tmp, fi.ModTime(), fi.ModTime())
+		if err := os.Rename(tmp, file); err != nil {
+			t.Fatal(err)
+		}
+		expectPoll(t, pw, polled{file, unix.IN_MODIFY})
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		os.Remove(file)
+		os.RemoveAll(filepath.Join(dir, "pkg"))
+		expectPoll(t, pw, polled{file, unix.IN_DELETE}, polled{nested, unix.IN_DELETE})
+	})
+}
+
+func TestPollFilesPresentAtWatchAreNotNew(t *testing.T) {
+	pw, err := NewPollWatcher(config.DefaultConfig(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "main.go"), "package main\n")
+	if err := pw.Watch(dir); err != nil {
+		t.Fatal(err)
+	}
+	expectPoll(t, pw)
+}
+
+func TestPollSkipsIgnoredAndHiddenDirectories(t *testing.T) {
+	c := config.DefaultConfig()
+	c.Filewatcher.Ignore = append(c.Filewatcher.Ignore, "^node_modules/")
+	c.Filewatcher.IgnoreGlob = []string{"build/"}
+	pw, dir := newTestWatcher(t, c)
+
+	for _, p := range []string{"node_modules/x/index.js", "build/out.js", ".git/HEAD", "web/.cache/data", "main_test.go", "a.out"} {
+		writeFile(t, filepath.Join(dir, p), "x")
+	}
+	expectPoll(t, pw)
+
+	// Only the root and web are walked.
+	if got := pw.WatchedDirs(); got != 2 {
+		t.Errorf("WatchedDirs() = %d, want 2", got)
+	}
+
+	web := filepath.Join(dir, "web", "app.js")
+	writeFile(t, web, "x")
+	expectPoll(t, pw, polled{web, unix.IN_CREATE})
+}
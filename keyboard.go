@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var KeyboardNotTerminal = errors.New("Stdin is not a terminal")
+
+const keyboardHelp = "Keys: r rebuild, s restart, c clear, p pause/resume, v verbose, q quit"
+
+// Keyboard reads single key presses from a terminal. The terminal is put in a mode without line
+// buffering and echo, but with signals left on so that Ctrl-C still stops kjor.
+type Keyboard struct {
+	in    *os.File
+	saved *unix.Termios
+	keys  chan byte
+}
+
+// NewKeyboard takes over in if it is a terminal, and returns KeyboardNotTerminal otherwise, as
+// when running in a container without a TTY.
+func NewKeyboard(in *os.File) (*Keyboard, error) {
+	fd := int(in.Fd())
+	saved, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, KeyboardNotTerminal
+	}
+
+	raw := *saved
+	raw.Lflag &^= unix.ICANON | unix.ECHO
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		return nil, fmt.Errorf("Failed to set terminal mode: [%v]", err)
+	}
+
+	k := &Keyboard{in: in, saved: saved, keys: make(chan byte)}
+	go k.read()
+	return k, nil
+}
+
+// read runs until stdin is closed. It is left blocked in Read when kjor exits.
+func (k *Keyboard) read() {
+	defer close(k.keys)
+
+	buf := make([]byte, 16)
+	for {
+		n, err := k.in.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for _, key := range buf[:n] {
+			k.keys <- key
+		}
+	}
+}
+
+func (k *Keyboard) Keys() <-chan byte {
+	return k.keys
+}
+
+// Close gives the terminal back the way it was.
+func (k *Keyboard) Close() error {
+	return unix.IoctlSetTermios(int(k.in.Fd()), unix.TCSETS, k.saved)
+}
+
+// handleKeys runs the command of every key pressed until ctx is cancelled. Rebuilds, restarts
+// and pausing go through the dispatcher, like changes to files do.
+func handleKeys(ctx context.Context, keys <-chan byte, dispatcher *Dispatcher, levels *logLevels, quit func(), logger *slog.Logger) {
+	for {
+		var key byte
+		select {
+		case k, ok := <-keys:
+			if !ok {
+				return
+			}
+			key = k
+		case <-ctx.Done():
+			return
+		}
+
+		switch key {
+		case 'r':
+			dispatcher.Send(CommandRebuild)
+		case 's':
+			dispatcher.Send(CommandRestart)
+		case 'p':
+			dispatcher.Send(CommandTogglePause)
+		case 'c':
+			fmt.Print("\x1b[H\x1b[2J\x1b[3J")
+		case 'v':
+			levels.SetVerbose(!levels.Verbose())
+			logger.Info("Verbose logging", "enabled", levels.Verbose())
+		case 'q':
+			logger.Info("Quitting")
+			quit()
+			return
+		case 'h', '?':
+			logger.Info(keyboardHelp)
+		}
+	}
+}
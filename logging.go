@@ -18,7 +18,7 @@ type KjorOutput struct {
 	FileWatcher     slog.Handler
 }
 
-func FancyKjorLogger(buildLevel slog.Level, SSELevel slog.Level, fileWatcherLevel slog.Level) *KjorOutput {
+func FancyKjorLogger(buildLevel slog.Leveler, SSELevel slog.Leveler, fileWatcherLevel slog.Leveler) *KjorOutput {
 	return &KjorOutput{
 		Build: NewTerminalLoggerWithName(os.Stdout, buildLevel, "Prc", Color{0,0,0}, Color{0,255,0}),
 		ProgramStandard: NewAppProcessWriter(os.Stdout),
@@ -28,7 +28,7 @@ func FancyKjorLogger(buildLevel slog.Level, SSELevel slog.Level, fileWatcherLeve
 	}
 }
 
-func UnfancyKjorLogger(buildLevel slog.Level, SSELevel slog.Level, fileWatcherLevel slog.Level) *KjorOutput {
+func UnfancyKjorLogger(buildLevel slog.Leveler, SSELevel slog.Leveler, fileWatcherLevel slog.Leveler) *KjorOutput {
 	return &KjorOutput{
 		Build: slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{AddSource: false, Level: buildLevel}),
 		ProgramStandard: os.Stdout,
@@ -40,11 +40,11 @@ func UnfancyKjorLogger(buildLevel slog.Level, SSELevel slog.Level, fileWatcherLe
 
 type TerminalLogger struct {
 	streamName string
-	level      slog.Level
+	level      slog.Leveler
 	out        io.Writer
 }
 
-func NewTerminalLoggerWithName(out io.Writer, level slog.Level, name string, fg Color, bg Color) *TerminalLogger {
+func NewTerminalLoggerWithName(out io.Writer, level slog.Leveler, name string, fg Color, bg Color) *TerminalLogger {
 	logger := &TerminalLogger{
 		level: level,
 		out:   out,
@@ -53,7 +53,7 @@ func NewTerminalLoggerWithName(out io.Writer, level slog.Level, name string, fg
 	return logger
 }
 
-func NewTerminalLogger(out io.Writer, level slog.Level) *TerminalLogger {
+func NewTerminalLogger(out io.Writer, level slog.Leveler) *TerminalLogger {
 	return &TerminalLogger{
 		level: level,
 		out:   out,
@@ -84,7 +84,7 @@ func (tl *TerminalLogger) lvlFormat(lvl slog.Level) (string, string) {
 }
 
 func (tl *TerminalLogger) Enabled(ctx context.Context, level slog.Level) bool {
-	return level >= tl.level
+	return level >= tl.level.Level()
 }
 
 func (tl *TerminalLogger) Handle(ctx context.Context, r slog.Record) error {
@@ -3,17 +3,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
 	"math/rand"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/subfusc/kjor/config"
 	"github.com/subfusc/kjor/file_watcher"
+	"github.com/subfusc/kjor/proxy"
 	"github.com/subfusc/kjor/sse"
 )
 
@@ -87,19 +92,69 @@ func checkSupport(c *config.Config) {
 	}
 }
 
-func loggerFromConfig(c *config.Config) *KjorOutput {
-	levels := []slog.Level{slog.LevelInfo, slog.LevelWarn, slog.LevelError}
-	if c.Logger.Verbose {
-		levels = []slog.Level{slog.LevelDebug, slog.LevelDebug, slog.LevelDebug}
+// logLevels are the levels of the loggers, which can be changed while kjor runs.
+type logLevels struct {
+	main        slog.LevelVar
+	build       slog.LevelVar
+	sse         slog.LevelVar
+	fileWatcher slog.LevelVar
+}
+
+func (l *logLevels) SetVerbose(verbose bool) {
+	if verbose {
+		l.main.Set(slog.LevelDebug)
+		l.build.Set(slog.LevelDebug)
+		l.sse.Set(slog.LevelDebug)
+		l.fileWatcher.Set(slog.LevelDebug)
+		return
 	}
+
+	l.main.Set(slog.LevelInfo)
+	l.build.Set(slog.LevelInfo)
+	l.sse.Set(slog.LevelWarn)
+	l.fileWatcher.Set(slog.LevelError)
+}
+
+func (l *logLevels) Verbose() bool {
+	return l.build.Level() == slog.LevelDebug
+}
+
+func loggerFromConfig(c *config.Config) (*KjorOutput, *logLevels) {
+	levels := &logLevels{}
+	levels.SetVerbose(c.Logger.Verbose)
 	if c.Logger.Style == "terminal" {
-		return FancyKjorLogger(levels[0], levels[1], levels[2])
+		return FancyKjorLogger(&levels.build, &levels.sse, &levels.fileWatcher), levels
+	}
+
+	return UnfancyKjorLogger(&levels.build, &levels.sse, &levels.fileWatcher), levels
+}
+
+// migrateConfig runs `kjor config migrate [file]`.
+func migrateConfig(args []string) int {
+	file := "kjor.toml"
+	if len(args) > 0 {
+		file = args[0]
 	}
 
-	return UnfancyKjorLogger(levels[0], levels[1], levels[2])
+	migrated, err := config.Migrate(file)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	if migrated {
+		fmt.Printf("Migrated %s to version %d, the old file is kept as %s.bak\n", file, config.CurrentVersion, file)
+	} else {
+		fmt.Printf("%s is already up to date\n", file)
+	}
+	return 0
 }
 
 func main() {
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "migrate" {
+		os.Exit(migrateConfig(os.Args[3:]))
+	}
+
 	cfg, err := config.ReadConfig()
 	switch {
 	case errors.Is(err, config.ConfigNotFound) :
@@ -113,35 +168,82 @@ func main() {
 		enc.Encode(cfg)
 		file.Close()
 	case err != nil:
-		fmt.Println("Unable to read config")
-		os.Exit(1)
-	case !cfg.IsValid():
-		fmt.Println("Config is not complete")
+		fmt.Println(err)
 		os.Exit(1)
 	}
 
 	checkSupport(cfg)
 
+	// os.Exit does not run deferred calls, so everything that needs cleaning up lives in run.
+	os.Exit(run(cfg))
+}
+
+func run(cfg *config.Config) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	wd, err := os.Getwd()
 	if err != nil {
 		fmt.Printf("Unable to find Working Directory: %s\n", wd)
-		os.Exit(1)
+		return 1
 	}
 
-	loggers := loggerFromConfig(cfg)
+	loggers, levels := loggerFromConfig(cfg)
 
 	fw, err := file_watcher.NewFileWatcher(
 		cfg,
 		slog.New(loggers.FileWatcher),
 	)
-	fw.Watch(wd)
-
 	if err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		return 1
 	}
 	defer fw.Close()
 
+	// The build writes the output and its temporary file, which must not trigger another build.
+	// The compiler writes files of its own next to the temporary file, so those go as well.
+	if output, tmpOutput := buildOutput(cfg); output != "" {
+		if !filepath.IsAbs(output) {
+			output, tmpOutput = filepath.Join(wd, output), filepath.Join(wd, tmpOutput)
+		}
+		fw.Ignore(output, false)
+		fw.Ignore(tmpOutput, true)
+	}
+
+	roots := newWatchRoots(fw, wd, cfg, slog.New(loggers.FileWatcher))
+	if err := roots.Update(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	sseLog := slog.New(loggers.SSE)
+	var sseServer *sse.Server
+	if cfg.SSE.Enable {
+		sseServer = sse.NewServer(cfg, sseLog)
+		defer sseServer.Close()
+
+		go func() {
+			if err := sseServer.Start(ctx); err != nil {
+				sseLog.Error("SSE server stopped", "err", err)
+			}
+		}()
+	}
+
+	if cfg.Proxy.Enable {
+		proxyServer, err := proxy.NewServer(cfg, sseServer.Handler(), sseLog)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer proxyServer.Close()
+
+		go func() {
+			if err := proxyServer.Start(ctx); err != nil {
+				sseLog.Error("Proxy stopped", "err", err)
+			}
+		}()
+	}
+
 	proc, err := NewProcess(
 		cfg,
 		slog.New(loggers.Build),
@@ -150,44 +252,73 @@ func main() {
 	)
 	if err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		return 1
 	}
 	defer proc.Stop()
 
-	proc.Start()
+	state := proc.State()
+	state.WatchedDirsFrom(fw.WatchedDirs)
 
-	sseLog := slog.New(loggers.SSE)
-	var sseServer *sse.Server
-	if cfg.SSE.Enable {
-		sseServer = sse.NewServer(cfg, sseLog)
-		defer sseServer.Close()
-
-		go sseServer.Start()
+	// Called from both the supervisor and the dispatcher, so it must never block.
+	publish := func(eventType string, data map[string]any) {
+		state.Record(eventType, data)
+		if cfg.SSE.Enable {
+			sseServer.Publish(sse.Event{Type: eventType, Source: sse.WATCHER, Data: data, When: time.Now()})
+		}
 	}
-
-	go fw.Start()
+	proc.OnEvent(publish)
 
 	var mainSlog *slog.Logger
 	if cfg.Logger.Style == "terminal" {
-		mainSlog = slog.New(NewTerminalLoggerWithName(os.Stdout, slog.LevelInfo, "Mn ", Color{255,255,255}, Color{200,30,30}))
+		mainSlog = slog.New(NewTerminalLoggerWithName(os.Stdout, &levels.main, "Mn ", Color{255,255,255}, Color{200,30,30}))
 	} else {
-		mainSlog = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{}))
+		mainSlog = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: &levels.main}))
 	}
 
-	for range fw.EventStream() {
-		err, restarted := proc.Restart()
+	dispatcher, err := NewDispatcher(cfg, proc, wd, publish, mainSlog)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
 
-		if cfg.SSE.Enable && len(sseServer.MsgChan) < cap(sseServer.MsgChan) {
-			switch {
-			case errors.Is(err, ProcessBuildFailed):
-				sseServer.MsgChan <- sse.Event{Type: "build_message", Source: sse.WATCHER, Data: map[string]any{"message": "Build failed"}, When: time.Now()}
-			case restarted && cap(sseServer.MsgChan) > len(sseServer.MsgChan):
-				sseServer.MsgChan <- sse.Event{Type: "build_action", Source: sse.WATCHER, Data: map[string]any{"restarted": true}, When: time.Now()}
-			}
-		}
+	if cfg.SSE.Enable {
+		sseServer.HandleControl(&control{dispatcher: dispatcher, state: state})
+	}
 
-		if err != nil && !errors.Is(err, ProcessBuildFailed) {
-			mainSlog.Error("Got an error thrown into main loop", "err", err)
+	// Stdin belongs to the program when it is forwarded.
+	if cfg.Program.Stdin != string(StdinForward) {
+		if keyboard, err := NewKeyboard(os.Stdin); err == nil {
+			defer keyboard.Close()
+			mainSlog.Info(keyboardHelp)
+			go handleKeys(ctx, keyboard.Keys(), dispatcher, levels, stop, mainSlog)
+		} else if !errors.Is(err, KeyboardNotTerminal) {
+			mainSlog.Warn("Keyboard commands disabled", "err", err)
 		}
 	}
+
+	// The first build runs as a job like any other, so that a failure is reported to the browser.
+	dispatcher.Rebuild(ctx)
+
+	fwErr := make(chan error, 1)
+	go func() {
+		fwErr <- fw.Start(ctx)
+	}()
+
+	// The event stream is closed by the watcher when ctx is cancelled or reading events fails,
+	// which in turn closes the batch stream.
+	debouncer := NewDebouncer(
+		time.Duration(cfg.Filewatcher.Debounce)*time.Millisecond,
+		time.Duration(cfg.Filewatcher.MaxWait)*time.Millisecond,
+		nil,
+	)
+	go debouncer.Run(ctx, roots.Follow(ctx, fw.EventStream()))
+	dispatcher.Run(ctx, debouncer.Batches())
+
+	if err := <-fwErr; err != nil {
+		mainSlog.Error("File watcher stopped", "err", err)
+		return 1
+	}
+
+	mainSlog.Info("Shutting down")
+	return 0
 }
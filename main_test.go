@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSetVerboseChangesMainLogger(t *testing.T) {
+	levels := &logLevels{}
+	levels.SetVerbose(false)
+
+	var out bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: &levels.main}))
+
+	logger.Debug("hidden")
+	levels.SetVerbose(true)
+	logger.Debug("shown")
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("Debug is not enabled after SetVerbose(true)")
+	}
+
+	levels.SetVerbose(false)
+	logger.Debug("hidden again")
+
+	if got := out.String(); strings.Contains(got, "hidden") || !strings.Contains(got, "shown") {
+		t.Errorf("Got log output:\n%s", got)
+	}
+}
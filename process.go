@@ -7,10 +7,17 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/subfusc/kjor/config"
+	"golang.org/x/sys/unix"
 )
 
 type AppProcessWriter struct {
@@ -42,64 +49,276 @@ func (apw *AppProcessWriter) Write(out []byte) (int, error) {
 }
 
 type Executable struct {
-	Program string
-	Args    []string
+	Program     string
+	Args        []string
+	Env         []string
+	Dir         string
+	StopSignal  syscall.Signal
+	StopTimeout time.Duration
+}
+
+type BuildStep struct {
+	Name            string
+	Exe             Executable
+	ContinueOnError bool
+}
+
+// BuildError tells which step of the build failed, and what it printed. It matches
+// ProcessBuildFailed with errors.Is.
+type BuildError struct {
+	Step        string
+	Err         error
+	Output      []string
+	Diagnostics []Diagnostic
+}
+
+func (be *BuildError) Error() string {
+	return fmt.Sprintf("Build step %s failed: [%v]", be.Step, be.Err)
+}
+
+func (be *BuildError) Is(target error) bool {
+	return target == ProcessBuildFailed
+}
+
+func (be *BuildError) Unwrap() error {
+	return be.Err
 }
 
 var (
-	ProcessBuildFailed = errors.New("Build failed")
+	ProcessBuildFailed    = errors.New("Build failed")
+	ProcessBuildCancelled = errors.New("Build cancelled")
+	ProcessNotBuilt       = errors.New("Program has not been built yet")
+)
+
+const (
+	defaultStopSignal  = "SIGTERM"
+	defaultStopTimeout = 5000
+	outputPlaceholder  = "{{output}}"
 )
 
 type Process struct {
-	appError      io.Writer
-	appOutput     io.Writer
-	cancel        context.CancelFunc
-	cmd           *exec.Cmd
-	lastRestarted time.Time
-	builder       Executable
-	runner        Executable
-	buildtOnce    bool
-	processLog    *slog.Logger
+	appError       io.Writer
+	appOutput      io.Writer
+	run            *programRun
+	ctx            context.Context
+	mu             sync.Mutex
+	buildSteps     []BuildStep
+	runner         Executable
+	output         string
+	tmpOutput      string
+	readiness      *Readiness
+	restartPolicy  RestartPolicy
+	maxRestarts    int
+	restartBackoff time.Duration
+	crashes        int
+	// crashRestart cancels a restart by the supervisor. It has its own lock, as it is called
+	// before taking mu, which the supervisor holds while it waits for the program to get ready.
+	crashRestartMu sync.Mutex
+	crashRestart   context.CancelFunc
+	stderrTail     *tailWriter
+	notify         func(eventType string, data map[string]any)
+	state          *StateTracker
+	stdin          *stdinForwarder
+	buildtOnce     bool
+	processLog     *slog.Logger
 }
 
 func ProgramNotFound(err error) error {
 	return fmt.Errorf("Failed to find program: [%v]", err)
 }
 
+func UnknownSignal(name string) error {
+	return fmt.Errorf("Unknown stop signal: [%s]", name)
+}
+
+// tmpOutputPath returns a hidden file next to output for the build to write to. Being in the
+// same directory keeps the final rename atomic.
+func tmpOutputPath(output string) string {
+	dir, file := filepath.Split(output)
+	return filepath.Join(dir, "."+file+".kjor-tmp")
+}
+
+// parseSignal accepts signal names both with and without the SIG prefix, e.g. SIGTERM or TERM.
+func parseSignal(name string) (syscall.Signal, error) {
+	if name == "" {
+		name = defaultStopSignal
+	}
+
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+
+	sig := unix.SignalNum(name)
+	if sig == 0 {
+		return 0, UnknownSignal(name)
+	}
+	return sig, nil
+}
+
+// newBuildSteps turns the build config into steps. A build without Steps is a single step running
+// Name with Args. Any {{output}} placeholder is replaced with tmpOutput.
+func newBuildSteps(c config.BuildConfig, tmpOutput string) ([]BuildStep, error) {
+	stepConfigs := c.Steps
+	if len(stepConfigs) == 0 {
+		stepConfigs = []config.BuildStep{{Name: "build", Command: c.Name, Args: c.Args}}
+	}
+
+	steps := make([]BuildStep, 0, len(stepConfigs))
+	for i, sc := range stepConfigs {
+		program, err := exec.LookPath(sc.Command)
+		if err != nil {
+			return nil, ProgramNotFound(err)
+		}
+
+		name := sc.Name
+		if name == "" {
+			name = fmt.Sprintf("%d", i+1)
+		}
+
+		args := make([]string, len(sc.Args))
+		for j, arg := range sc.Args {
+			args[j] = strings.ReplaceAll(arg, outputPlaceholder, tmpOutput)
+		}
+
+		steps = append(steps, BuildStep{
+			Name: name,
+			Exe: Executable{
+				Program:    program,
+				Args:       args,
+				Env:        sc.Env,
+				Dir:        sc.Dir,
+				StopSignal: syscall.SIGKILL,
+			},
+			ContinueOnError: sc.ContinueOnError,
+		})
+	}
+	return steps, nil
+}
+
+// buildOutput returns the build output and temporary output paths if the build uses the
+// {{output}} placeholder, and empty strings otherwise. With Steps, Build.Args is not used, so
+// only the arguments of the steps count.
+func buildOutput(c *config.Config) (string, string) {
+	args := [][]string{c.Build.Args}
+	if len(c.Build.Steps) > 0 {
+		args = args[:0]
+		for _, step := range c.Build.Steps {
+			args = append(args, step.Args)
+		}
+	}
+
+	usesPlaceholder := false
+	for _, a := range args {
+		usesPlaceholder = usesPlaceholder || slices.ContainsFunc(a, func(arg string) bool {
+			return strings.Contains(arg, outputPlaceholder)
+		})
+	}
+
+	if !usesPlaceholder {
+		return "", ""
+	}
+
+	output := c.Build.Output
+	if output == "" {
+		output = c.Program.Name
+	}
+	return output, tmpOutputPath(output)
+}
 
 func NewProcess(c *config.Config, logger *slog.Logger, stdOut io.Writer, stdErr io.Writer) (*Process, error) {
-	builder, err := exec.LookPath(c.Build.Name)
+	output, tmpOutput := buildOutput(c)
+	buildSteps, err := newBuildSteps(c.Build, tmpOutput)
+	if err != nil {
+		return nil, err
+	}
+
+	stopSignal, err := parseSignal(c.Program.StopSignal)
+	if err != nil {
+		return nil, err
+	}
+
+	stopTimeout := c.Program.StopTimeout
+	if stopTimeout <= 0 {
+		stopTimeout = defaultStopTimeout
+	}
+
+	readiness, err := NewReadiness(c.Program.Ready)
+	if err != nil {
+		return nil, err
+	}
+
+	restartPolicy, err := parseRestartPolicy(c.Program.Restart)
 	if err != nil {
-		return nil, ProgramNotFound(err)
+		return nil, err
+	}
+
+	maxRestarts := c.Program.MaxRestarts
+	if maxRestarts <= 0 {
+		maxRestarts = defaultMaxRestarts
+	}
+
+	restartBackoff := c.Program.RestartBackoff
+	if restartBackoff <= 0 {
+		restartBackoff = defaultRestartBackoff
+	}
+
+	stdinMode, err := parseStdinMode(c.Program.Stdin)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdin *stdinForwarder
+	if stdinMode == StdinForward {
+		stdin = newStdinForwarder(os.Stdin, logger)
 	}
 
 	return &Process{
-		appError:      stdErr,
-		appOutput:     stdOut,
-		cancel:        nil,
-		cmd:           nil,
-		lastRestarted: time.Now(),
+		appError:  stdErr,
+		appOutput: stdOut,
+		run:       nil,
+		ctx:       context.Background(),
 		runner: Executable{
-			Program: c.Program.Name,
-			Args:    c.Program.Args,
-		},
-		builder: Executable{
-			Program: builder,
-			Args:    c.Build.Args,
+			Program:     c.Program.Name,
+			Args:        c.Program.Args,
+			StopSignal:  stopSignal,
+			StopTimeout: time.Duration(stopTimeout) * time.Millisecond,
 		},
-		buildtOnce: false,
-		processLog: logger,
+		buildSteps:     buildSteps,
+		output:         output,
+		tmpOutput:      tmpOutput,
+		readiness:      readiness,
+		restartPolicy:  restartPolicy,
+		maxRestarts:    maxRestarts,
+		restartBackoff: time.Duration(restartBackoff) * time.Millisecond,
+		stderrTail:     newTailWriter(stderrTailLines),
+		notify:         func(string, map[string]any) {},
+		state:          NewStateTracker(),
+		stdin:          stdin,
+		buildtOnce:     false,
+		processLog:     logger,
 	}, nil
 }
 
-func (p *Process) newCmd(e Executable) (*exec.Cmd, context.CancelFunc) {
-	ctx, ctl := context.WithCancel(context.Background())
+func (p *Process) newCmd(parent context.Context, e Executable) (*exec.Cmd, context.CancelFunc) {
+	ctx, ctl := context.WithCancel(parent)
 	cmd := exec.CommandContext(ctx, e.Program, e.Args...)
+	// Run in a separate process group so that children of shell scripts and `go run` can be signalled
+	// together with the program itself.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// Ask nicely first. If the process is still around after WaitDelay, os/exec escalates to SIGKILL.
 	cmd.Cancel = func() error {
-		return cmd.Process.Kill()
+		return signalGroup(cmd.Process.Pid, e.StopSignal)
+	}
+	cmd.WaitDelay = e.StopTimeout
+
+	if len(e.Env) > 0 {
+		cmd.Env = append(os.Environ(), e.Env...)
 	}
+	cmd.Dir = e.Dir
 
-	// What about Stdin?
+	// Stdin is left nil, which reads as empty, unless startProgram forwards kjor's stdin.
 	cmd.Stdout = p.appOutput
 	cmd.Stderr = p.appError
 
@@ -116,47 +335,241 @@ func (p *Process) firstBuild() error {
 	return nil
 }
 
-func (p *Process) build() error {
-	cmd, _ := p.newCmd(p.builder)
+// build runs the build steps in order. Cancelling ctx kills the process group of the running step.
+func (p *Process) build(ctx context.Context) (err error) {
 	t := time.Now()
-	err := cmd.Run()
-	dx := time.Now().Sub(t)
-	if err == nil {
-		p.processLog.Info("Build", "time", dx)
-	} else {
-		p.processLog.Warn("Build failed", "err", err)
-		return ProcessBuildFailed
+	defer func() { p.state.BuildFinished(time.Since(t), err) }()
+
+	for _, step := range p.buildSteps {
+		cmd, _ := p.newCmd(ctx, step.Exe)
+		// The output still goes to the terminal, but is kept to tell the browser what failed.
+		output := newTailWriter(buildOutputLines)
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, output)
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, output)
+		st := time.Now()
+		err := cmd.Run()
+		dx := time.Now().Sub(st)
+		switch {
+		case err == nil && len(p.buildSteps) > 1:
+			p.processLog.Info("Build step", "step", step.Name, "time", dx)
+		case err == nil:
+		case ctx.Err() != nil:
+			p.processLog.Info("Build cancelled", "step", step.Name, "time", time.Now().Sub(t))
+			p.removeTmpOutput()
+			return ProcessBuildCancelled
+		case step.ContinueOnError:
+			p.processLog.Warn("Build step failed, continuing", "step", step.Name, "time", dx, "err", err)
+		default:
+			p.processLog.Warn("Build failed", "step", step.Name, "time", dx, "err", err)
+			p.removeTmpOutput()
+			lines := output.Lines()
+			return &BuildError{Step: step.Name, Err: err, Output: lines, Diagnostics: ParseDiagnostics(lines)}
+		}
+	}
+	p.processLog.Info("Build", "time", time.Now().Sub(t))
+
+	if p.output != "" {
+		if err := os.Rename(p.tmpOutput, p.output); err != nil {
+			p.processLog.Warn("Failed to replace build output", "output", p.output, "err", err)
+			return ProcessBuildFailed
+		}
 	}
 	return nil
 }
 
-func (p *Process) Start() error {
-	if err := p.build(); err != nil {
+// removeTmpOutput cleans up whatever a failed or cancelled build left behind.
+func (p *Process) removeTmpOutput() {
+	if p.tmpOutput == "" {
+		return
+	}
+
+	if err := os.Remove(p.tmpOutput); err != nil && !errors.Is(err, os.ErrNotExist) {
+		p.processLog.Warn("Failed to remove temporary build output", "path", p.tmpOutput, "err", err)
+	}
+}
+
+// Start builds and starts the program. Commands are tied to ctx, so cancelling it stops the
+// program with its stop policy.
+func (p *Process) Start(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.ctx = ctx
+	if err := p.build(ctx); err != nil {
 		return err
 	}
 
 	p.firstBuild()
-	p.cmd, p.cancel = p.newCmd(p.runner)
-	return p.cmd.Start()
+	return p.startProgram(ctx)
 }
 
-func (p *Process) Stop() {
-	if p.cancel != nil {
-		p.cancel()
+// startProgram starts the program and a supervisor waiting for it. If a readiness probe is
+// configured, it waits for the probe to pass. The program itself lives as long as p.ctx, but ctx
+// bounds the wait, so that a newer change does not have to wait for a program that is replaced
+// anyway.
+func (p *Process) startProgram(ctx context.Context) error {
+	cmd, cancel := p.newCmd(p.ctx, p.runner)
+	p.stderrTail.Reset()
+	cmd.Stderr = io.MultiWriter(cmd.Stderr, p.stderrTail)
+	if p.readiness != nil {
+		p.readiness.Reset()
+		if w := p.readiness.Writer(); w != nil {
+			cmd.Stdout = io.MultiWriter(cmd.Stdout, w)
+			cmd.Stderr = io.MultiWriter(cmd.Stderr, w)
+		}
+	}
+
+	var stdin io.WriteCloser
+	if p.stdin != nil {
+		pipe, err := cmd.StdinPipe()
+		if err != nil {
+			cancel()
+			p.run = nil
+			return err
+		}
+		stdin = pipe
+	}
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		p.run = nil
+		return err
+	}
+
+	if p.stdin != nil {
+		p.stdin.attach(stdin)
+		p.stdin.Start()
+	}
+
+	run := &programRun{cmd: cmd, cancel: cancel, done: make(chan struct{}), started: time.Now()}
+	p.run = run
+	p.state.ProgramStarted(cmd.Process.Pid)
+	go p.supervise(run)
+
+	if p.readiness == nil {
+		return nil
+	}
+
+	// Give up on the probe as soon as the program exits.
+	readyCtx, readyCancel := context.WithCancel(ctx)
+	defer readyCancel()
+	go func() {
+		select {
+		case <-run.done:
+			readyCancel()
+		case <-readyCtx.Done():
+		}
+	}()
+
+	t := time.Now()
+	if err := p.readiness.Wait(readyCtx); err != nil {
+		if ctx.Err() != nil {
+			p.processLog.Info("Stopped waiting for the program to become ready")
+			return ProcessBuildCancelled
+		}
+		p.processLog.Warn("Program did not become ready", "err", err)
+		return err
+	}
+	p.processLog.Info("Program ready", "time", time.Now().Sub(t))
+	return nil
+}
+
+// OnEvent sets a function that is called when something happens to the program that was not
+// the result of a call to Process, such as the program crashing.
+func (p *Process) OnEvent(notify func(eventType string, data map[string]any)) {
+	p.notify = notify
+}
+
+// State returns the tracker that the program's state is recorded in.
+func (p *Process) State() *StateTracker {
+	return p.state
+}
+
+// HasReadinessProbe tells whether a successful restart means the program is ready to serve.
+func (p *Process) HasReadinessProbe() bool {
+	return p.readiness != nil
+}
+
+// signalGroup sends sig to every process in the process group led by pid.
+func signalGroup(pid int, sig syscall.Signal) error {
+	err := unix.Kill(-pid, sig)
+	if errors.Is(err, unix.ESRCH) {
+		return nil
+	}
+	return err
+}
+
+// killLeftovers kills what remains of a process group after its leader has exited.
+func (p *Process) killLeftovers(pid int) {
+	if unix.Kill(-pid, 0) != nil {
+		return
+	}
+
+	p.processLog.Warn("Processes left in program group after exit, sent SIGKILL", "pgid", pid)
+	if err := signalGroup(pid, syscall.SIGKILL); err != nil {
+		p.processLog.Warn("Failed to kill process group", "pgid", pid, "err", err)
+	}
+}
+
+// stopProgram sends the stop signal to the program's process group and waits for it to exit.
+func (p *Process) stopProgram() error {
+	run := p.run
+	p.run = nil
+
+	run.stopped.Store(true)
+	run.cancel()
+	<-run.done
+
+	if run.cmd.ProcessState != nil {
+		status, ok := run.cmd.ProcessState.Sys().(syscall.WaitStatus)
+		if ok && status.Signaled() && status.Signal() == syscall.SIGKILL && p.runner.StopSignal != syscall.SIGKILL {
+			p.processLog.Warn(
+				"Program did not stop in time, sent SIGKILL",
+				"signal", p.runner.StopSignal,
+				"timeout", p.runner.StopTimeout,
+			)
+		}
+	}
+
+	p.killLeftovers(run.cmd.Process.Pid)
+
+	// A program exiting cleanly on the stop signal makes Wait report the context as the cause.
+	var exitErr *exec.ExitError
+	err := run.err
+	if err != nil && !errors.As(err, &exitErr) && !errors.Is(err, exec.ErrWaitDelay) && !errors.Is(err, context.Canceled) {
+		return err
 	}
+	return nil
 }
 
-func (p *Process) restartable() bool {
-	return p.lastRestarted.Add(1 * time.Second).After(time.Now())
+func (p *Process) Stop() {
+	p.cancelCrashRestart()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.run == nil {
+		return
+	}
+
+	if err := p.stopProgram(); err != nil {
+		p.processLog.Warn("Failed to stop program", "err", err)
+	}
 }
 
-func (p *Process) Restart() (error, bool) {
+// Restart rebuilds and restarts the program. The build runs under ctx, and cancelling it aborts
+// the build and leaves the running program untouched. Restarts are serialized, so a new Restart
+// waits for a cancelled one to finish killing its build.
+func (p *Process) Restart(ctx context.Context) (error, bool) {
+	p.cancelCrashRestart()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	if !p.buildtOnce {
-		if p.cmd != nil || p.cancel != nil {
+		if p.run != nil {
 			panic("process exists even if buildtOnce is false. This can cause multiple process to spawn")
 		}
 
-		if err := p.build(); err != nil {
+		if err := p.build(ctx); err != nil {
 			return err, false
 		}
 
@@ -164,32 +577,73 @@ func (p *Process) Restart() (error, bool) {
 			return err, false
 		}
 	} else {
-		if p.restartable() {
-			return nil, false
+		if err := p.build(ctx); err != nil {
+			return err, false
 		}
 
-		if err := p.build(); err != nil {
-			return err, false
+		if p.run != nil {
+			if err := p.stopProgram(); err != nil {
+				return err, false
+			}
 		}
+	}
 
-		p.cancel()
-		err := p.cmd.Wait()
-		if _, ok := err.(*exec.ExitError); !ok {
+	// A rebuild gives a crashing program a fresh set of restarts.
+	p.crashes = 0
+
+	if err := p.startProgram(ctx); err != nil {
+		return err, false
+	}
+
+	p.processLog.Debug("Process restarted successfully")
+	return nil, true
+}
+
+// RestartProgram restarts the program without building it first. Cancelling ctx stops waiting for
+// the program to become ready.
+func (p *Process) RestartProgram(ctx context.Context) (error, bool) {
+	p.cancelCrashRestart()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.buildtOnce {
+		return ProcessNotBuilt, false
+	}
+
+	if p.run != nil {
+		if err := p.stopProgram(); err != nil {
 			return err, false
 		}
 	}
 
-	p.cmd, p.cancel = p.newCmd(p.runner)
-	p.lastRestarted = time.Now()
+	p.crashes = 0
+	if err := p.startProgram(ctx); err != nil {
+		return err, false
+	}
 
-	p.processLog.Debug("Process restarted successfully")
-	return p.cmd.Start(), true
+	p.processLog.Debug("Process restarted without build")
+	return nil, true
 }
 
-func (p *Process) RestartWithArgs(args ...string) (error, bool) {
-	if p.restartable() {
-		return nil, false
+// RunCommand runs a command next to the program, with its output going to the program's output.
+// Cancelling ctx kills the command's process group.
+func (p *Process) RunCommand(ctx context.Context, command []string) error {
+	program, err := exec.LookPath(command[0])
+	if err != nil {
+		return ProgramNotFound(err)
 	}
+
+	cmd, _ := p.newCmd(ctx, Executable{Program: program, Args: command[1:], StopSignal: syscall.SIGKILL})
+	t := time.Now()
+	if err := cmd.Run(); err != nil {
+		p.processLog.Warn("Command failed", "command", command, "err", err)
+		return err
+	}
+	p.processLog.Info("Command", "command", command, "time", time.Now().Sub(t))
+	return nil
+}
+
+func (p *Process) RestartWithArgs(ctx context.Context, args ...string) (error, bool) {
 	p.runner.Args = args
-	return p.Restart()
+	return p.Restart(ctx)
 }
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/subfusc/kjor/config"
+)
+
+// The test binary doubles as the program kjor runs. KJOR_HELPER picks what it does.
+const helperEnv = "KJOR_HELPER"
+
+// TestHelperProcess is not a test, but the helper program started by the tests below.
+func TestHelperProcess(t *testing.T) {
+	mode := os.Getenv(helperEnv)
+	if mode == "" {
+		return
+	}
+
+	switch mode {
+	case "trap":
+		// Writes the name of the signal it got to KJOR_HELPER_OUT and exits.
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		fmt.Println("ready")
+		sig := <-signals
+		os.WriteFile(os.Getenv("KJOR_HELPER_OUT"), []byte(sig.String()), 0644)
+		os.Exit(0)
+	case "ignore":
+		signal.Ignore(syscall.SIGTERM, syscall.SIGINT)
+		fmt.Println("ready")
+		time.Sleep(time.Minute)
+	}
+	os.Exit(2)
+}
+
+// syncBuffer is a bytes.Buffer that can be written from several goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+// waitFor polls cond until it is true, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testProcess returns a Process running program with args, built by a no-op build, with its
+// output and log going to the returned buffers.
+func testProcess(t *testing.T, program config.ProgConfig) (*Process, *syncBuffer, *syncBuffer) {
+	t.Helper()
+
+	c := config.DefaultConfig()
+	c.Program = program
+	c.Build = config.BuildConfig{Name: "true"}
+
+	output, log := &syncBuffer{}, &syncBuffer{}
+	logger := slog.New(slog.NewTextHandler(log, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	p, err := NewProcess(c, logger, output, output)
+	if err != nil {
+		t.Fatalf("NewProcess: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		p.Stop()
+		cancel()
+	})
+
+	if err := p.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return p, output, log
+}
+
+func helperProgram(stopSignal string, stopTimeout int) config.ProgConfig {
+	return config.ProgConfig{
+		Name:        os.Args[0],
+		Args:        []string{"-test.run=^TestHelperProcess$"},
+		StopSignal:  stopSignal,
+		StopTimeout: stopTimeout,
+	}
+}
+
+func TestStopDeliversStopSignal(t *testing.T) {
+	tests := []struct {
+		stopSignal string
+		want       string
+	}{
+		{"SIGTERM", syscall.SIGTERM.String()},
+		{"INT", syscall.SIGINT.String()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.stopSignal, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "signal")
+			t.Setenv(helperEnv, "trap")
+			t.Setenv("KJOR_HELPER_OUT", out)
+
+			p, output, log := testProcess(t, helperProgram(test.stopSignal, 5000))
+			waitFor(t, "the helper to start", func() bool { return strings.Contains(output.String(), "ready") })
+
+			start := time.Now()
+			p.Stop()
+			if took := time.Since(start); took > 2*time.Second {
+				t.Errorf("Stop took %v, the helper should exit on the signal", took)
+			}
+
+			got, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatalf("The helper did not record a signal: %v", err)
+			}
+			if string(got) != test.want {
+				t.Errorf("Got signal %q, want %q", got, test.want)
+			}
+
+			if strings.Contains(log.String(), "sent SIGKILL") {
+				t.Errorf("SIGKILL was sent to a helper that stopped:\n%s", log)
+			}
+		})
+	}
+}
+
+func TestStopEscalatesToSIGKILL(t *testing.T) {
+	t.Setenv(helperEnv, "ignore")
+
+	const stopTimeout = 300
+	p, output, log := testProcess(t, helperProgram("SIGTERM", stopTimeout))
+	waitFor(t, "the helper to start", func() bool { return strings.Contains(output.String(), "ready") })
+	pid := p.run.cmd.Process.Pid
+
+	start := time.Now()
+	p.Stop()
+	took := time.Since(start)
+
+	if took < stopTimeout*time.Millisecond {
+		t.Errorf("Stop took %v, less than StopTimeout", took)
+	}
+
+	if err := syscall.Kill(pid, 0); err == nil {
+		t.Errorf("Helper %d is still running", pid)
+	}
+
+	if !strings.Contains(log.String(), "Program did not stop in time, sent SIGKILL") {
+		t.Errorf("The escalation was not logged:\n%s", log)
+	}
+}
+
+// gone tells whether pid has exited. A killed process whose parent is gone may linger as a zombie
+// until init reaps it, which counts as gone.
+func gone(pid int) bool {
+	if err := syscall.Kill(pid, 0); err != nil {
+		return true
+	}
+
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	// The state follows the command name, which is in parentheses.
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestRestartKillsLeftovers(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	// The sleeper ignores SIGTERM, so only killLeftovers can get rid of it once the shell is gone.
+	script := fmt.Sprintf(`(trap "" TERM; exec sleep 60 >/dev/null 2>&1) & echo $! > %s; echo ready; wait`, pidFile)
+
+	p, output, log := testProcess(t, config.ProgConfig{Name: "sh", Args: []string{"-c", script}, StopTimeout: 2000})
+	waitFor(t, "the script to start", func() bool { return strings.Contains(output.String(), "ready") })
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("Failed to read the sleeper's pid: %v", err)
+	}
+	var sleeper int
+	fmt.Sscan(string(data), &sleeper)
+
+	if err, _ := p.RestartProgram(context.Background()); err != nil {
+		t.Fatalf("RestartProgram: %v", err)
+	}
+
+	waitFor(t, fmt.Sprintf("sleeper %d to be killed", sleeper), func() bool { return gone(sleeper) })
+
+	if !strings.Contains(log.String(), "Processes left in program group after exit") {
+		t.Errorf("Killing the leftovers was not logged:\n%s", log)
+	}
+}
+
+func TestStopDoesNotWaitForCrashRestart(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "crashed")
+	// Crashes once after getting ready, and never gets ready again after the restart.
+	script := fmt.Sprintf(`if [ -e %[1]s ]; then exec sleep 60 >/dev/null 2>&1; fi; touch %[1]s; echo ready; sleep 0.2; exit 1`, marker)
+	program := config.ProgConfig{
+		Name:           "sh",
+		Args:           []string{"-c", script},
+		StopTimeout:    2000,
+		Restart:        "on-failure",
+		RestartBackoff: 10,
+		Ready:          config.ReadyConfig{LogLine: "ready", Timeout: 30000, Interval: 10},
+	}
+
+	p, _, log := testProcess(t, program)
+	waitFor(t, "the program to be restarted", func() bool { return strings.Contains(log.String(), "Restarting program") })
+	// Give the supervisor time to take the lock and start waiting for the program to get ready.
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	p.Stop()
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("Stop took %v, waiting for the restarted program to get ready", took)
+	}
+
+	if strings.Contains(log.String(), "Failed to restart program") {
+		t.Errorf("A cancelled restart was reported as failed:\n%s", log)
+	}
+}
+
+func TestBuildOutput(t *testing.T) {
+	tests := []struct {
+		name  string
+		build config.BuildConfig
+		want  string
+	}{
+		{"args", config.BuildConfig{Name: "go", Args: []string{"build", "-o", "{{output}}"}}, "a.out"},
+		{"no placeholder", config.BuildConfig{Name: "make"}, ""},
+		{"steps", config.BuildConfig{Steps: []config.BuildStep{
+			{Command: "go", Args: []string{"generate"}},
+			{Command: "go", Args: []string{"build", "-o", "{{output}}"}},
+		}}, "a.out"},
+		// The default Args are not used when there are steps.
+		{"steps ignore args", config.BuildConfig{
+			Name:  "go",
+			Args:  []string{"build", "-o", "{{output}}"},
+			Steps: []config.BuildStep{{Command: "make"}},
+		}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := config.DefaultConfig()
+			c.Program.Name = "a.out"
+			c.Build = test.build
+
+			output, tmpOutput := buildOutput(c)
+			if output != test.want {
+				t.Errorf("buildOutput() = %q, want %q", output, test.want)
+			}
+			if (tmpOutput == "") != (test.want == "") {
+				t.Errorf("buildOutput() temporary output = %q with output %q", tmpOutput, output)
+			}
+		})
+	}
+}
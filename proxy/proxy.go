@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/subfusc/kjor/config"
+)
+
+// Prefix is reserved for kjor on the proxied origin. Requests below it never reach the program.
+const Prefix = "/__kjor/"
+
+const (
+	retryInterval = 100 * time.Millisecond
+	// maxRetryBody is the largest request body kept in memory to be sent again.
+	maxRetryBody = 1 << 20
+)
+
+var (
+	listenerScript = []byte(`<script src="` + Prefix + `listener.js"></script>`)
+	closingBody    = []byte("</body>")
+)
+
+var ProxyInvalidTarget = errors.New("Invalid proxy target")
+
+// Server proxies requests to the program, adding the listener script to every HTML page and
+// serving the SSE endpoints under Prefix.
+type Server struct {
+	logger *slog.Logger
+	srv    *http.Server
+}
+
+func NewServer(c *config.Config, kjor http.Handler, logger *slog.Logger) (*Server, error) {
+	target, err := url.Parse(c.Proxy.Target)
+	if err != nil || target.Host == "" {
+		return nil, fmt.Errorf("%w: [%s]", ProxyInvalidTarget, c.Proxy.Target)
+	}
+
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.Out.Host = r.In.Host
+			r.SetXForwarded()
+			// gzip is the only encoding the script can be injected into.
+			if strings.Contains(r.In.Header.Get("Accept-Encoding"), "gzip") {
+				r.Out.Header.Set("Accept-Encoding", "gzip")
+			} else {
+				r.Out.Header.Del("Accept-Encoding")
+			}
+		},
+		Transport: &retryTransport{
+			base:    http.DefaultTransport,
+			timeout: time.Duration(c.Proxy.Timeout) * time.Millisecond,
+			logger:  logger,
+		},
+		ModifyResponse: injectListener,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Warn("Failed to proxy request", "url", r.URL.String(), "err", err)
+			http.Error(w, fmt.Sprintf("kjor: program is not reachable: %v", err), http.StatusBadGateway)
+		},
+	}
+	kjor = http.StripPrefix(strings.TrimSuffix(Prefix, "/"), kjor)
+
+	return &Server{
+		logger: logger,
+		srv: &http.Server{
+			Addr: fmt.Sprintf(":%d", c.Proxy.Port),
+			// Not a ServeMux, which would clean and redirect paths before the program sees them.
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasPrefix(r.URL.Path, Prefix) {
+					kjor.ServeHTTP(w, r)
+					return
+				}
+				rp.ServeHTTP(w, r)
+			}),
+		},
+	}, nil
+}
+
+// Start serves until ctx is cancelled.
+func (s *Server) Start(ctx context.Context) error {
+	s.logger.Info("Starting proxy", "Addr", s.srv.Addr)
+	s.srv.BaseContext = func(net.Listener) context.Context { return ctx }
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		s.srv.Shutdown(shutdownCtx)
+	}()
+
+	if err := s.srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// retryTransport holds requests while the program is restarting, by retrying them until the
+// program accepts connections again or the timeout expires.
+type retryTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+	logger  *slog.Logger
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A failed attempt closes the body, so every attempt needs a new one. Bodies without GetBody
+	// are kept in memory if they are small, and sent once without being held if they are not.
+	getBody := req.GetBody
+	if req.Body != nil && req.Body != http.NoBody {
+		if getBody == nil {
+			body, err := io.ReadAll(io.LimitReader(req.Body, maxRetryBody+1))
+			if err != nil {
+				req.Body.Close()
+				return nil, err
+			}
+
+			if len(body) > maxRetryBody {
+				attempt := req.Clone(req.Context())
+				attempt.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+				return t.base.RoundTrip(attempt)
+			}
+
+			getBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(body)), nil
+			}
+		}
+		req.Body.Close()
+	}
+
+	deadline := time.Now().Add(t.timeout)
+	for {
+		attempt := req.Clone(req.Context())
+		if getBody != nil {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			attempt.Body = body
+			attempt.GetBody = getBody
+		}
+
+		resp, err := t.base.RoundTrip(attempt)
+		// Only a refused connection is retried, since nothing has been sent to the program then.
+		if err == nil || !errors.Is(err, syscall.ECONNREFUSED) || time.Now().After(deadline) {
+			return resp, err
+		}
+
+		t.logger.Debug("Program not accepting connections, holding request", "url", req.URL.String())
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// injectListener adds the listener script before the closing body tag of HTML pages, or at the
+// end if there is none.
+func injectListener(resp *http.Response) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	noBody := resp.Request.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified
+	if mediaType != "text/html" || noBody || resp.ContentLength == 0 {
+		return nil
+	}
+
+	var reader io.Reader = resp.Body
+	switch resp.Header.Get("Content-Encoding") {
+	case "":
+	case "gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("Failed to decompress response: [%v]", err)
+		}
+		reader = gz
+	default:
+		return nil
+	}
+
+	body, err := io.ReadAll(reader)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to read response: [%v]", err)
+	}
+
+	at := len(body)
+	for i := len(body) - len(closingBody); i >= 0; i-- {
+		if bytes.EqualFold(body[i:i+len(closingBody)], closingBody) {
+			at = i
+			break
+		}
+	}
+	body = slices.Concat(body[:at], listenerScript, body[at:])
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Content-Encoding")
+	// The page no longer matches what the program tagged.
+	resp.Header.Del("ETag")
+	return nil
+}
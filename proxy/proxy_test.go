@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/subfusc/kjor/config"
+)
+
+const page = "<html><body><h1>Hello</h1></body></html>"
+
+// newTestProxy returns the URL of a proxy in front of target.
+func newTestProxy(t *testing.T, target string) string {
+	t.Helper()
+
+	c := config.DefaultConfig()
+	c.Proxy.Target = target
+	c.Proxy.Timeout = 5000
+	kjor := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "kjor "+r.URL.Path)
+	})
+
+	s, err := NewServer(c, kjor, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	front := httptest.NewServer(s.srv.Handler)
+	t.Cleanup(front.Close)
+	return front.URL
+}
+
+// newTestTarget returns the URL of handler behind a proxy.
+func newTestTarget(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+
+	target := httptest.NewServer(handler)
+	t.Cleanup(target.Close)
+	return newTestProxy(t, target.URL)
+}
+
+// do sends req without the client decompressing anything, and returns the response and its body.
+func do(t *testing.T, req *http.Request) (*http.Response, string) {
+	t.Helper()
+
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", req.Method, req.URL, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read the body: %v", err)
+	}
+	return resp, string(body)
+}
+
+func get(t *testing.T, url string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return do(t, req)
+}
+
+func htmlHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("ETag", `"v1"`)
+	if r.Header.Get("If-None-Match") == `"v1"` {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	io.WriteString(w, page)
+}
+
+func TestProxyInjectsIntoHTML(t *testing.T) {
+	url := newTestTarget(t, htmlHandler)
+
+	resp, body := get(t, url+"/")
+	want := strings.Replace(page, "</body>", string(listenerScript)+"</body>", 1)
+	if body != want {
+		t.Errorf("Got body %q, want %q", body, want)
+	}
+	if resp.ContentLength != int64(len(want)) {
+		t.Errorf("Content-Length is %d, want %d", resp.ContentLength, len(want))
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		t.Errorf("The ETag %s of the original page was kept", etag)
+	}
+}
+
+func TestProxyInjectsIntoGzipHTML(t *testing.T) {
+	url := newTestTarget(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			io.WriteString(w, page)
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		io.WriteString(gz, page)
+		gz.Close()
+	})
+
+	want := strings.Replace(page, "</body>", string(listenerScript)+"</body>", 1)
+	for _, acceptEncoding := range []string{"gzip, deflate, br", "br"} {
+		req, err := http.NewRequest(http.MethodGet, url+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+
+		resp, body := do(t, req)
+		if body != want {
+			t.Errorf("Accept-Encoding %s: Got body %q, want %q", acceptEncoding, body, want)
+		}
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+			t.Errorf("Accept-Encoding %s: Got Content-Encoding %s", acceptEncoding, encoding)
+		}
+	}
+}
+
+func TestProxyLeavesOtherContentAlone(t *testing.T) {
+	const data = `{"body": "</body>"}`
+	url := newTestTarget(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, data)
+	})
+
+	resp, body := get(t, url+"/api")
+	if body != data {
+		t.Errorf("Got body %q, want %q", body, data)
+	}
+	if etag := resp.Header.Get("ETag"); etag != `"v1"` {
+		t.Errorf("Got ETag %q, want \"v1\"", etag)
+	}
+
+	// Nor does it proxy what is below Prefix.
+	if _, body := get(t, url+Prefix+"events"); body != "kjor /events" {
+		t.Errorf("Got body %q below the prefix", body)
+	}
+}
+
+func TestProxyHeadAndNotModified(t *testing.T) {
+	url := newTestTarget(t, htmlHandler)
+
+	req, err := http.NewRequest(http.MethodHead, url+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, body := do(t, req); resp.StatusCode != http.StatusOK || body != "" {
+		t.Errorf("HEAD got %d with body %q", resp.StatusCode, body)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, url+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", `"v1"`)
+	resp, body := do(t, req)
+	if resp.StatusCode != http.StatusNotModified || body != "" {
+		t.Errorf("Got %d with body %q, want 304 without a body", resp.StatusCode, body)
+	}
+	if etag := resp.Header.Get("ETag"); etag != `"v1"` {
+		t.Errorf("Got ETag %q, want \"v1\"", etag)
+	}
+}
+
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	io.Copy(w, r.Body)
+}
+
+func TestProxyHoldsRequestsWhileTargetIsDown(t *testing.T) {
+	// Find a free port, and start the target on it only after the request is sent.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	url := newTestProxy(t, "http://"+addr)
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Errorf("Failed to start the target: %v", err)
+			return
+		}
+		srv := &http.Server{Handler: http.HandlerFunc(echoHandler)}
+		t.Cleanup(func() { srv.Close() })
+		srv.Serve(l)
+	}()
+
+	start := time.Now()
+	resp, err := http.Post(url+"/form", "text/plain", strings.NewReader("sent while down"))
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "sent while down" {
+		t.Errorf("Got %d with body %q, want the body sent back", resp.StatusCode, body)
+	}
+	if took := time.Since(start); took < 300*time.Millisecond {
+		t.Errorf("Got a response after %v, before the target was up", took)
+	}
+}
+
+func TestProxyStreamsLargeBodies(t *testing.T) {
+	url := newTestTarget(t, echoHandler)
+
+	data := bytes.Repeat([]byte("x"), 3*maxRetryBody)
+	resp, err := http.Post(url+"/upload", "text/plain", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(body, data) {
+		t.Errorf("Got %d bytes back, want %d", len(body), len(data))
+	}
+}
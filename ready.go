@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/subfusc/kjor/config"
+)
+
+const (
+	defaultReadyTimeout  = 30000
+	defaultReadyInterval = 250
+)
+
+var (
+	ProcessStartFailed = errors.New("Program did not become ready")
+)
+
+// ReadinessProbe tells whether the program is ready to serve. Check is called repeatedly until it
+// returns nil or the probe times out.
+type ReadinessProbe interface {
+	Check(ctx context.Context) error
+	// Reset is called every time a new program is started.
+	Reset()
+}
+
+// HTTPProbe is ready when a GET request to url gets a response that is not a server error.
+type HTTPProbe struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPProbe(url string) *HTTPProbe {
+	return &HTTPProbe{url: url, client: &http.Client{Timeout: time.Second}}
+}
+
+func (hp *HTTPProbe) Check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hp.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := hp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("Got status %d from %s", resp.StatusCode, hp.url)
+	}
+	return nil
+}
+
+func (hp *HTTPProbe) Reset() {}
+
+// TCPProbe is ready when a connection to addr can be established.
+type TCPProbe struct {
+	addr string
+}
+
+func NewTCPProbe(addr string) *TCPProbe {
+	return &TCPProbe{addr: addr}
+}
+
+func (tp *TCPProbe) Check(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", tp.addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (tp *TCPProbe) Reset() {}
+
+// LogLineProbe is ready when the program has written a line matching re. It sits next to the
+// program's output as an io.Writer.
+type LogLineProbe struct {
+	re      *regexp.Regexp
+	mu      sync.Mutex
+	partial []byte
+	matched bool
+}
+
+func NewLogLineProbe(re *regexp.Regexp) *LogLineProbe {
+	return &LogLineProbe{re: re}
+}
+
+func (lp *LogLineProbe) Write(out []byte) (int, error) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	lp.partial = append(lp.partial, out...)
+	for {
+		i := bytes.IndexByte(lp.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		if !lp.matched && lp.re.Match(lp.partial[:i]) {
+			lp.matched = true
+		}
+		lp.partial = lp.partial[i+1:]
+	}
+
+	return len(out), nil
+}
+
+func (lp *LogLineProbe) Check(ctx context.Context) error {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if !lp.matched {
+		return fmt.Errorf("No line matching %s yet", lp.re)
+	}
+	return nil
+}
+
+func (lp *LogLineProbe) Reset() {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	lp.partial = nil
+	lp.matched = false
+}
+
+// Readiness runs a probe until it passes or times out.
+type Readiness struct {
+	probe    ReadinessProbe
+	timeout  time.Duration
+	interval time.Duration
+}
+
+// NewReadiness returns nil if no probe is configured. At most one of HTTP, TCP and LogLine
+// may be set.
+func NewReadiness(c config.ReadyConfig) (*Readiness, error) {
+	var probe ReadinessProbe
+	configured := 0
+
+	if c.HTTP != "" {
+		probe = NewHTTPProbe(c.HTTP)
+		configured++
+	}
+
+	if c.TCP != "" {
+		probe = NewTCPProbe(c.TCP)
+		configured++
+	}
+
+	if c.LogLine != "" {
+		re, err := regexp.Compile(c.LogLine)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to compile LogLine re: [%v]", err)
+		}
+		probe = NewLogLineProbe(re)
+		configured++
+	}
+
+	switch configured {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, errors.New("Only one of HTTP, TCP and LogLine can be used as readiness probe")
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultReadyTimeout
+	}
+
+	interval := c.Interval
+	if interval <= 0 {
+		interval = defaultReadyInterval
+	}
+
+	return &Readiness{
+		probe:    probe,
+		timeout:  time.Duration(timeout) * time.Millisecond,
+		interval: time.Duration(interval) * time.Millisecond,
+	}, nil
+}
+
+// Writer returns a writer the program's output should be copied to, or nil if the probe does not
+// look at output.
+func (r *Readiness) Writer() io.Writer {
+	if w, ok := r.probe.(io.Writer); ok {
+		return w
+	}
+	return nil
+}
+
+func (r *Readiness) Reset() {
+	r.probe.Reset()
+}
+
+// Wait blocks until the probe passes. It returns ProcessStartFailed, wrapping the last probe
+// error, if the probe has not passed within the timeout.
+func (r *Readiness) Wait(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		err := r.probe.Check(ctx)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%w: [%v]", ProcessStartFailed, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPProbe(t *testing.T) {
+	tests := []struct {
+		status int
+		ready  bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusNotFound, true},
+		{http.StatusInternalServerError, false},
+		{http.StatusServiceUnavailable, false},
+	}
+
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+			}))
+			defer srv.Close()
+
+			err := NewHTTPProbe(srv.URL).Check(context.Background())
+			if (err == nil) != test.ready {
+				t.Errorf("Check() = %v, want ready %t", err, test.ready)
+			}
+		})
+	}
+
+	t.Run("not listening", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		url := srv.URL
+		srv.Close()
+
+		if err := NewHTTPProbe(url).Check(context.Background()); err == nil {
+			t.Error("Check() passed without a server")
+		}
+	})
+}
+
+// closedAddr returns an address nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestTCPProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if err := NewTCPProbe(l.Addr().String()).Check(context.Background()); err != nil {
+		t.Errorf("Check() = %v with a listener", err)
+	}
+
+	if err := NewTCPProbe(closedAddr(t)).Check(context.Background()); err == nil {
+		t.Error("Check() passed without a listener")
+	}
+}
+
+func TestLogLineProbe(t *testing.T) {
+	probe := NewLogLineProbe(regexp.MustCompile(`listening on :\d+`))
+	ctx := context.Background()
+
+	probe.Write([]byte("starting\nlistening "))
+	if probe.Check(ctx) == nil {
+		t.Fatal("Check() passed on a partial line")
+	}
+
+	// The line is matched once it is complete, even when written in pieces.
+	probe.Write([]byte("on :8080"))
+	probe.Write([]byte("\nmore output\n"))
+	if err := probe.Check(ctx); err != nil {
+		t.Fatalf("Check() = %v after the line was written", err)
+	}
+
+	probe.Reset()
+	if probe.Check(ctx) == nil {
+		t.Fatal("Check() passed after Reset")
+	}
+
+	probe.Write([]byte("listening on :8080\n"))
+	if err := probe.Check(ctx); err != nil {
+		t.Fatalf("Check() = %v after Reset and a new line", err)
+	}
+}
+
+func TestReadinessTimesOut(t *testing.T) {
+	r := &Readiness{probe: NewTCPProbe(closedAddr(t)), timeout: 100 * time.Millisecond, interval: 10 * time.Millisecond}
+
+	err := r.Wait(context.Background())
+	if !errors.Is(err, ProcessStartFailed) {
+		t.Errorf("Wait() = %v, want ProcessStartFailed", err)
+	}
+}
+
+// A newer change cancels the job restarting the program, which must not have to wait for the
+// probe to time out.
+func TestRestartStopsWaitingWhenCancelled(t *testing.T) {
+	t.Setenv(helperEnv, "trap")
+	t.Setenv("KJOR_HELPER_OUT", filepath.Join(t.TempDir(), "signal"))
+
+	p, output, _ := testProcess(t, helperProgram("SIGTERM", 5000))
+	waitFor(t, "the helper to start", func() bool { return strings.Contains(output.String(), "ready") })
+
+	p.readiness = &Readiness{probe: NewTCPProbe(closedAddr(t)), timeout: 30 * time.Second, interval: 10 * time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	err, _ := p.RestartProgram(ctx)
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("RestartProgram took %v after being cancelled", took)
+	}
+	if !errors.Is(err, ProcessBuildCancelled) {
+		t.Errorf("RestartProgram() = %v, want ProcessBuildCancelled", err)
+	}
+}
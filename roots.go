@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/subfusc/kjor/config"
+	"github.com/subfusc/kjor/file_watcher"
+	"github.com/subfusc/kjor/file_watcher/common"
+)
+
+// localReplaces returns the targets of the replace directives in goMod that are directories on
+// disk rather than modules, made absolute. A missing go.mod has no replaces.
+func localReplaces(goMod string) ([]string, error) {
+	data, err := os.ReadFile(goMod)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: [%v]", goMod, err)
+	}
+
+	dir := filepath.Dir(goMod)
+	replaces := make([]string, 0)
+	inBlock := false
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+
+		switch {
+		case inBlock && line == ")":
+			inBlock = false
+			continue
+		case inBlock:
+		case strings.HasPrefix(line, "replace ") || strings.HasPrefix(line, "replace("):
+			line = strings.TrimSpace(strings.TrimPrefix(line, "replace"))
+			if line == "(" {
+				inBlock = true
+				continue
+			}
+		default:
+			continue
+		}
+
+		_, target, ok := strings.Cut(line, "=>")
+		fields := strings.Fields(target)
+		if !ok || len(fields) == 0 {
+			continue
+		}
+
+		// Like the go command, only paths starting with ./ or ../, or absolute ones, are local.
+		p := strings.Trim(fields[0], "\"`")
+		switch {
+		case filepath.IsAbs(p):
+		case p == "." || p == ".." || strings.HasPrefix(p, "./") || strings.HasPrefix(p, "../"):
+			p = filepath.Join(dir, p)
+		default:
+			continue
+		}
+		replaces = append(replaces, filepath.Clean(p))
+	}
+	return replaces, nil
+}
+
+// watchRoots keeps the file watcher watching Filewatcher.Paths and, with WatchReplaces, the local
+// replace targets of go.mod, which are looked up again every time go.mod changes.
+type watchRoots struct {
+	fw      file_watcher.FileWatcher
+	wd      string
+	cfg     *config.Config
+	mu      sync.Mutex
+	current map[string]bool
+	logger  *slog.Logger
+}
+
+func newWatchRoots(fw file_watcher.FileWatcher, wd string, cfg *config.Config, logger *slog.Logger) *watchRoots {
+	return &watchRoots{
+		fw:      fw,
+		wd:      wd,
+		cfg:     cfg,
+		current: make(map[string]bool),
+		logger:  logger,
+	}
+}
+
+func (r *watchRoots) goMod() string {
+	return filepath.Join(r.wd, "go.mod")
+}
+
+// paths returns the absolute paths that should be watched. Paths inside another one are left
+// out, so that ignore patterns stay relative to the outermost directory.
+func (r *watchRoots) paths() []string {
+	paths := r.cfg.Filewatcher.Paths
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	wanted := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(r.wd, p)
+		}
+		wanted = append(wanted, filepath.Clean(p))
+	}
+
+	if r.cfg.Filewatcher.WatchReplaces {
+		replaces, err := localReplaces(r.goMod())
+		if err != nil {
+			r.logger.Error("Failed to find replace directives", "err", err)
+		}
+		wanted = append(wanted, replaces...)
+	}
+
+	outermost := make([]string, 0, len(wanted))
+	for _, p := range wanted {
+		inside := false
+		for _, q := range wanted {
+			if p != q && strings.HasPrefix(p, q+string(filepath.Separator)) {
+				inside = true
+				break
+			}
+		}
+
+		if !inside {
+			outermost = append(outermost, p)
+		}
+	}
+	return outermost
+}
+
+// Update watches the paths that are new and unwatches the ones that are gone.
+func (r *watchRoots) Update() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	errs := make([]error, 0)
+	wanted := make(map[string]bool)
+	for _, p := range r.paths() {
+		if wanted[p] {
+			continue
+		}
+
+		if !r.current[p] {
+			if err := r.fw.Watch(p); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			r.logger.Info("Watching", "path", p)
+		}
+		wanted[p] = true
+	}
+
+	for p := range r.current {
+		if !wanted[p] {
+			if err := r.fw.Unwatch(p); err != nil {
+				errs = append(errs, err)
+			}
+			r.logger.Info("Stopped watching", "path", p)
+		}
+	}
+
+	r.current = wanted
+	return errors.Join(errs...)
+}
+
+// Follow passes on the events from in, and updates the roots first when go.mod has changed. The
+// returned stream is closed when in is.
+func (r *watchRoots) Follow(ctx context.Context, in <-chan common.Event) <-chan common.Event {
+	out := make(chan common.Event)
+	go func() {
+		defer close(out)
+		for event := range in {
+			if r.cfg.Filewatcher.WatchReplaces && event.FileName == r.goMod() {
+				if err := r.Update(); err != nil {
+					r.logger.Error("Failed to update watched paths", "err", err)
+				}
+			}
+
+			select {
+			case out <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,141 @@
+package sse
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	publishBuffer = 64
+	clientBuffer  = 16
+	historySize   = 100
+)
+
+// client is a single /listen connection. Its events channel is closed by the hub when the client
+// is unregistered or is too slow to keep up. Events after lastID are replayed when it registers.
+type client struct {
+	events chan Event
+	lastID uint64
+}
+
+func newClient(lastID uint64) *client {
+	// Room for a full replay on top of the normal buffer.
+	return &client{events: make(chan Event, clientBuffer+historySize), lastID: lastID}
+}
+
+// hub fans every published event out to all registered clients.
+type hub struct {
+	publish        chan Event
+	register       chan *client
+	unregister     chan *client
+	done           chan struct{}
+	clients        map[*client]bool
+	history        []Event
+	nextID         uint64
+	restartTimeout time.Duration
+	lastReload     time.Time
+	dropped        func(reason string)
+}
+
+func newHub(restartTimeout time.Duration, dropped func(reason string)) *hub {
+	return &hub{
+		publish:    make(chan Event, publishBuffer),
+		register:   make(chan *client),
+		unregister: make(chan *client),
+		done:       make(chan struct{}),
+		clients:    make(map[*client]bool),
+		history:    make([]Event, 0, historySize),
+		// Starting at the current time keeps IDs increasing when kjor is restarted, so a
+		// browser holding an ID from an earlier run does not miss events.
+		nextID:         uint64(time.Now().UnixMilli()),
+		restartTimeout: restartTimeout,
+		dropped:        dropped,
+	}
+}
+
+func isReload(e Event) bool {
+	return e.Type == "build_action" && e.Data["restarted"] != nil
+}
+
+func (h *hub) remove(c *client) {
+	if h.clients[c] {
+		delete(h.clients, c)
+		close(c.events)
+	}
+}
+
+// broadcast sends e to every client without blocking. Clients with a full buffer are dropped,
+// which closes their connection and makes the browser reconnect.
+func (h *hub) broadcast(e Event) {
+	if isReload(e) {
+		// The program announcing itself and the RestartTimeout expiring are the same reload.
+		if h.lastReload.Add(1 * time.Second).After(e.When) {
+			return
+		}
+		h.lastReload = e.When
+	}
+
+	h.nextID++
+	e.ID = h.nextID
+	if len(h.history) == historySize {
+		h.history = append(h.history[:0], h.history[1:]...)
+	}
+	h.history = append(h.history, e)
+
+	for c := range h.clients {
+		select {
+		case c.events <- e:
+		default:
+			h.dropped("client too slow")
+			h.remove(c)
+		}
+	}
+}
+
+// run is the only goroutine touching the set of clients. It returns when ctx is cancelled,
+// closing all clients and done.
+func (h *hub) run(ctx context.Context) {
+	defer close(h.done)
+
+	var delayed <-chan time.Time
+	var delayedEvent Event
+
+	for {
+		select {
+		case c := <-h.register:
+			h.clients[c] = true
+			if c.lastID != 0 {
+				for _, e := range h.history {
+					if e.ID > c.lastID {
+						c.events <- e
+					}
+				}
+			}
+		case c := <-h.unregister:
+			h.remove(c)
+		case e := <-h.publish:
+			ready, _ := e.Data["ready"].(bool)
+			switch {
+			case e.Source == WATCHER && isReload(e) && !ready:
+				// Wait RestartTimeout to give the program time to start, unless it tells
+				// us it has started before that.
+				delayedEvent = e
+				delayed = time.After(h.restartTimeout)
+			case e.Source == DEV_SERVER:
+				delayed = nil
+				h.broadcast(e)
+			default:
+				h.broadcast(e)
+			}
+		case <-delayed:
+			delayed = nil
+			delayedEvent.When = time.Now()
+			h.broadcast(delayedEvent)
+		case <-ctx.Done():
+			for c := range h.clients {
+				h.remove(c)
+			}
+			return
+		}
+	}
+}
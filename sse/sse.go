@@ -7,9 +7,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/subfusc/kjor/config"
@@ -20,7 +25,9 @@ const (
 	DEV_SERVER
 )
 
+// Event is sent to the browser. ID is assigned by the server when the event is broadcast.
 type Event struct {
+	ID     uint64
 	Type   string
 	Source uint
 	When   time.Time
@@ -28,21 +35,49 @@ type Event struct {
 }
 
 func (e Event) ToMessage() string {
-	e.Data["When"] = e.When
+	// The same event is sent to every client, so the data map is copied rather than modified.
+	data := make(map[string]any, len(e.Data)+1)
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	data["When"] = e.When
 
 	buf := bytes.NewBuffer(nil)
 	enc := json.NewEncoder(buf)
-	enc.Encode(e.Data)
-	return fmt.Sprintf("event: %s\ndata: %s\n\n", e.Type, buf.String())
+	enc.Encode(data)
+	if e.ID == 0 {
+		return fmt.Sprintf("event: %s\ndata: %s\n\n", e.Type, buf.String())
+	}
+	return fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, buf.String())
 }
 
+// How long the browser should wait before reconnecting.
+const retryMillis = 1000
+
 type Server struct {
 	logger         *slog.Logger
 	srv            *http.Server
-	MsgChan        chan Event
+	hub            *hub
+	cssRoutes      map[string]string
 	RestartTimeout int
 }
 
+// cssURL maps a changed file to the URL it is served under, using the longest matching route.
+// Files outside every route are assumed to be served from the root with the same path.
+func (s *Server) cssURL(path string) string {
+	best := ""
+	for dir := range s.cssRoutes {
+		if (path == dir || strings.HasPrefix(path, dir+"/")) && len(dir) > len(best) {
+			best = dir
+		}
+	}
+
+	if best == "" {
+		return "/" + path
+	}
+	return s.cssRoutes[best] + strings.TrimPrefix(path, best)
+}
+
 func sseHeaders(h http.Header) {
 	h.Set("Content-Type", "text/event-stream")
 	h.Set("Cache-Control", "no-cache")
@@ -51,6 +86,26 @@ func sseHeaders(h http.Header) {
 	h.Set("X-Accel-Buffering", "no")
 }
 
+// Publish queues e for every connected client. It never blocks, and returns false if the event
+// had to be dropped because the queue is full.
+func (s *Server) Publish(e Event) bool {
+	if paths, ok := e.Data["paths"].([]string); ok && e.Type == "css_changed" {
+		urls := make([]string, len(paths))
+		for i, path := range paths {
+			urls[i] = s.cssURL(path)
+		}
+		e.Data["urls"] = urls
+	}
+
+	select {
+	case s.hub.publish <- e:
+		return true
+	default:
+		s.logger.Warn("Event queue full, dropping event", "type", e.Type)
+		return false
+	}
+}
+
 func (s *Server) SSETrapper() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		s.logger.Info("Opening socket")
@@ -58,53 +113,44 @@ func (s *Server) SSETrapper() http.HandlerFunc {
 		sse := w.(http.Flusher)
 		defer func() { s.logger.Info("Closing socket") }()
 
-		lastSent := time.Now()
-
-		delayed := struct {
-			Ctx  context.Context
-			Ctl  context.CancelFunc
-			Done bool
-		}{Done: true}
-
-		delayedSend := func(c context.Context, message Event) {
-			<-c.Done()
-			switch c.Err() {
-			case context.Canceled:
-			case context.DeadlineExceeded:
-				if lastSent.Add(1 * time.Second).Before(message.When) {
-					fmt.Fprint(w, message.ToMessage())
-					sse.Flush()
-					lastSent = time.Now()
-				}
-			}
+		// EventSource sends Last-Event-ID when it reconnects. After a page reload listener.js
+		// passes the last ID it saw as a query parameter instead.
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.URL.Query().Get("lastEventId")
+		}
+		id, _ := strconv.ParseUint(lastID, 10, 64)
 
-			delayed.Done = true
+		c := newClient(id)
+		select {
+		case s.hub.register <- c:
+		case <-r.Context().Done():
+			return
+		case <-s.hub.done:
+			return
 		}
 
+		// The request context is done by the time this runs, so only a stopped hub may skip the
+		// unregister.
+		defer func() {
+			select {
+			case s.hub.unregister <- c:
+			case <-s.hub.done:
+			}
+		}()
+
+		fmt.Fprintf(w, "retry: %d\n\n", retryMillis)
+		sse.Flush()
+
 		for {
 			select {
-			case message := <-s.MsgChan:
-				switch message.Source {
-				case WATCHER:
-					if message.Type == "build_action" &&  message.Data["restarted"] != nil && delayed.Done {
-						delayed.Ctx, delayed.Ctl = context.WithTimeout(context.Background(), time.Duration(s.RestartTimeout)*time.Millisecond)
-						delayed.Done = false
-						go delayedSend(delayed.Ctx, message)
-					} else {
-						fmt.Fprintf(w, message.ToMessage())
-						sse.Flush()
-					}
-				case DEV_SERVER:
-					if !delayed.Done {
-						delayed.Ctl()
-					}
-
-					if lastSent.Add(1 * time.Second).Before(message.When) {
-						fmt.Fprint(w, message.ToMessage())
-						sse.Flush()
-						lastSent = time.Now()
-					}
+			case message, ok := <-c.events:
+				if !ok {
+					return
 				}
+
+				fmt.Fprint(w, message.ToMessage())
+				sse.Flush()
 			case <-r.Context().Done():
 				return
 			}
@@ -114,25 +160,32 @@ func (s *Server) SSETrapper() http.HandlerFunc {
 
 func NewServer(c *config.Config, logger *slog.Logger) *Server {
 	mux := &http.ServeMux{}
+	cssRoutes := make(map[string]string, len(c.SSE.CSSRoutes))
+	for dir, url := range c.SSE.CSSRoutes {
+		cssRoutes[strings.Trim(dir, "/")] = strings.TrimSuffix(url, "/")
+	}
+
 	sseServer := &Server{
 		logger: logger,
 		srv: &http.Server{
 			Addr:    fmt.Sprintf(":%d", c.SSE.Port),
 			Handler: mux,
 		},
+		cssRoutes:      cssRoutes,
 		RestartTimeout: c.SSE.RestartTimeout,
 	}
+	sseServer.hub = newHub(time.Duration(c.SSE.RestartTimeout)*time.Millisecond, func(reason string) {
+		logger.Warn("Dropping client", "reason", reason)
+	})
 
 	mux.HandleFunc("GET /listen", sseServer.SSETrapper())
 	mux.HandleFunc("POST /started", func(w http.ResponseWriter, r *http.Request) {
-		if cap(sseServer.MsgChan) > len(sseServer.MsgChan) {
-			sseServer.MsgChan <- Event{Type: "build_action", Source: DEV_SERVER, When: time.Now(), Data: map[string]any{"restarted": true}}
-		}
+		sseServer.Publish(Event{Type: "build_action", Source: DEV_SERVER, When: time.Now(), Data: map[string]any{"restarted": true}})
 	})
 	mux.HandleFunc("GET /listener.js",
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "text/javascript")
-			w.Write([]byte(fmt.Sprintf(`
+			w.Write([]byte(`
         function hide(e) {
           div = document.getElementById("kjor-messages")
           div.style.display = "none"
@@ -162,35 +215,215 @@ func NewServer(c *config.Config, logger *slog.Logger) *Server {
         }
 
         addMessageNode()
-        const eventSrc = new EventSource("http://localhost:%d/listen")
+        const loadedAt = Date.now()
+        const lastEventId = sessionStorage.getItem("kjor-last-event-id")
+        // /listen is next to this script, both on the SSE port and behind the proxy.
+        const listenURL = new URL("listen", document.currentScript.src)
+        if (lastEventId) {
+          listenURL.searchParams.set("lastEventId", lastEventId)
+        }
+        const eventSrc = new EventSource(listenURL)
+
+        // Remember the last event so that events missed during a page reload are replayed.
+        function on(type, handler) {
+          eventSrc.addEventListener(type, (event) => {
+            sessionStorage.setItem("kjor-last-event-id", event.lastEventId)
+            handler(event)
+          })
+        }
+
+        // A replayed reload from before this page was loaded is already taken care of.
+        function reload(data) {
+          if (Date.parse(data["When"]) < loadedAt) {
+            return
+          }
+          eventSrc.close()
+          window.location.reload()
+        }
+
+        function hideOverlay() {
+          const overlay = document.getElementById("kjor-overlay")
+          if (overlay != null) {
+            overlay.remove()
+          }
+        }
+
+        // Show what the build printed over the whole page. Compiler messages are full of angle
+        // brackets, so they are added as text and never as HTML.
+        function showOverlay(data) {
+          hideOverlay()
+          const overlay = document.createElement("div")
+          overlay.id = "kjor-overlay"
+          overlay.style.cssText = "position: fixed; inset: 0; z-index: 2147483647; overflow: auto; padding: 20px; background: rgba(20, 20, 20, 0.95); color: #eee; font: 14px monospace"
+
+          const close = document.createElement("div")
+          close.textContent = "Ⓧ"
+          close.style.cssText = "position: absolute; top: 10px; right: 20px; cursor: pointer; font-size: 24px"
+          close.onclick = hideOverlay
+
+          const title = document.createElement("h2")
+          title.textContent = data["message"]
+          title.style.color = "orange"
+          overlay.append(close, title)
+
+          const diagnostics = data["diagnostics"] || []
+          for (const d of diagnostics) {
+            const item = document.createElement("pre")
+            const where = document.createElement("span")
+            where.textContent = d["file"] + ":" + d["line"] + (d["column"] ? ":" + d["column"] : "")
+            where.style.color = "#6cf"
+            item.append(where, " " + d["message"])
+            overlay.append(item)
+          }
 
-        eventSrc.addEventListener("build_action", (event) => {
+          if (diagnostics.length == 0) {
+            const output = document.createElement("pre")
+            output.textContent = (data["output"] || []).join("\n")
+            overlay.append(output)
+          }
+          document.body.appendChild(overlay)
+        }
+
+        document.addEventListener("keydown", (event) => {
+          if (event.key == "Escape") {
+            hideOverlay()
+          }
+        })
+
+        on("build_action", (event) => {
+          hideOverlay()
           data = JSON.parse(event.data)
           if (data["restarted"]) {
-            eventSrc.close()
-            window.location.reload()
+            reload(data)
+          }
+        })
+        // Re-fetch the stylesheets that changed, matching on the full path first and the file name
+        // second. Reload the page if none of them are on it.
+        function swapStylesheets(urls) {
+          names = urls.map((u) => u.split("/").pop())
+          swapped = 0
+          for (const link of document.querySelectorAll("link[rel=stylesheet]")) {
+            href = new URL(link.href, window.location.href)
+            if (urls.includes(href.pathname) || names.includes(href.pathname.split("/").pop())) {
+              href.searchParams.set("kjor", Date.now())
+              link.href = href.toString()
+              swapped++
+            }
+          }
+          return swapped > 0
+        }
+
+        on("css_changed", (event) => {
+          data = JSON.parse(event.data)
+          if (Date.parse(data["When"]) < loadedAt) {
+            return
+          }
+          if (!swapStylesheets(data["urls"])) {
+            reload(data)
           }
         })
-        eventSrc.addEventListener("build_message", (event) => {
+
+        function showMessage(event) {
           data = JSON.parse(event.data)
           if (data["message"] != null) {
             msg = document.getElementById("kjor-messages")
             msg.innerHTML = "<p>" + data["message"] + "</p><div class=\"kjor-close\">Ⓧ</div>"
             msg.style.display = "flex"
           }
+        }
+
+        on("build_message", (event) => {
+          data = JSON.parse(event.data)
+          if (data["output"] != null) {
+            showOverlay(data)
+          } else {
+            showMessage(event)
+          }
+        })
+        on("start_failed", (event) => {
+          hideOverlay()
+          showMessage(event)
+        })
+        on("program_exited", (event) => {
+          data = JSON.parse(event.data)
+          status = data["signal"] != null ? "signal " + data["signal"] : "code " + data["code"]
+          msg = document.getElementById("kjor-messages")
+          msg.innerHTML = "<p>Program exited with " + status + "</p><div class=\"kjor-close\">Ⓧ</div>"
+          msg.style.display = "flex"
         })
-      `, c.SSE.Port)))
+      `))
 		}))
 	return sseServer
 }
 
-func (s *Server) Start() {
+// Controller is what the control API under /api drives. The commands return false if they
+// could not be queued.
+type Controller interface {
+	Rebuild() bool
+	Pause() bool
+	Resume() bool
+	Status() any
+}
+
+// HandleControl adds the control API. Commands are only accepted from tools and pages on the
+// same origin, so that any page open in the browser can not restart the program.
+func (s *Server) HandleControl(ctrl Controller) {
+	mux := s.srv.Handler.(*http.ServeMux)
+
+	command := func(name string, run func() bool) {
+		mux.HandleFunc("POST /api/"+name, func(w http.ResponseWriter, r *http.Request) {
+			if origin := r.Header.Get("Origin"); origin != "" {
+				if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+					http.Error(w, "Cross origin requests are not allowed", http.StatusForbidden)
+					return
+				}
+			}
+
+			if !run() {
+				http.Error(w, "Busy, try again", http.StatusServiceUnavailable)
+				return
+			}
+			s.logger.Info("Control command", "command", name)
+			w.WriteHeader(http.StatusAccepted)
+		})
+	}
+	command("restart", ctrl.Rebuild)
+	command("pause", ctrl.Pause)
+	command("resume", ctrl.Resume)
+
+	mux.HandleFunc("GET /api/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ctrl.Status()); err != nil {
+			s.logger.Warn("Failed to write status", "err", err)
+		}
+	})
+}
+
+// Handler serves /listen, /listener.js and /started, so they can be mounted on another server.
+func (s *Server) Handler() http.Handler {
+	return s.srv.Handler
+}
+
+// Start serves until ctx is cancelled. Open /listen sockets are tied to ctx, so they are closed
+// before the server shuts down.
+func (s *Server) Start(ctx context.Context) error {
 	s.logger.Info("Starting server", "Addr", s.srv.Addr)
-	s.MsgChan = make(chan Event, 1)
-	s.srv.ListenAndServe()
+	s.srv.BaseContext = func(net.Listener) context.Context { return ctx }
+	go s.hub.run(ctx)
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		s.srv.Shutdown(shutdownCtx)
+	}()
+
+	if err := s.srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
 func (s *Server) Close() {
-	close(s.MsgChan)
 	s.srv.Close()
 }
@@ -0,0 +1,192 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/subfusc/kjor/config"
+)
+
+// syncBuffer is a bytes.Buffer that can be written from several goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+func (sb *syncBuffer) Count(s string) int {
+	return strings.Count(sb.String(), s)
+}
+
+// waitFor polls cond until it is true, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testServer serves a Server with httptest. The hub runs until the returned cancel is called.
+func testServer(t *testing.T) (*Server, *httptest.Server, *syncBuffer, context.CancelFunc) {
+	t.Helper()
+
+	log := &syncBuffer{}
+	s := NewServer(config.DefaultConfig(), slog.New(slog.NewTextHandler(log, nil)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.hub.run(ctx)
+
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(func() {
+		cancel()
+		srv.Close()
+	})
+	return s, srv, log, cancel
+}
+
+type testClient struct {
+	resp   *http.Response
+	lines  *bufio.Scanner
+	cancel context.CancelFunc
+}
+
+// listen connects to /listen, and returns once the client is registered with the hub, which is
+// before the retry line is sent.
+func listen(t *testing.T, srv *httptest.Server) *testClient {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/listen", nil)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		cancel()
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	c := &testClient{resp: resp, lines: bufio.NewScanner(resp.Body), cancel: cancel}
+	t.Cleanup(c.close)
+	if !c.lines.Scan() || !strings.HasPrefix(c.lines.Text(), "retry: ") {
+		t.Fatalf("Got %q, want the retry line", c.lines.Text())
+	}
+	return c
+}
+
+// next returns the type of the next event.
+func (c *testClient) next() (string, bool) {
+	for c.lines.Scan() {
+		if event, ok := strings.CutPrefix(c.lines.Text(), "event: "); ok {
+			return event, true
+		}
+	}
+	return "", false
+}
+
+func (c *testClient) close() {
+	c.cancel()
+	c.resp.Body.Close()
+}
+
+func TestConcurrentClientsGetEveryEvent(t *testing.T) {
+	s, srv, _, _ := testServer(t)
+
+	const clients = 10
+	conns := make([]*testClient, clients)
+	for i := range conns {
+		conns[i] = listen(t, srv)
+	}
+
+	types := []string{"build_message", "css_changed", "start_failed"}
+	for _, typ := range types {
+		s.Publish(Event{Type: typ, When: time.Now(), Data: map[string]any{}})
+	}
+
+	var wg sync.WaitGroup
+	for i, c := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, want := range types {
+				if got, ok := c.next(); !ok || got != want {
+					t.Errorf("Client %d got event %q, want %q", i, got, want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDisconnectedClientsAreUnregistered(t *testing.T) {
+	s, srv, log, _ := testServer(t)
+
+	const clients = 10
+	var wg sync.WaitGroup
+	for range clients {
+		c := listen(t, srv)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.close()
+		}()
+	}
+	wg.Wait()
+	waitFor(t, "the sockets to close", func() bool { return log.Count("Closing socket") == clients })
+
+	// A client left registered fills up and is dropped as too slow.
+	for range clientBuffer + historySize + 1 {
+		s.hub.publish <- Event{Type: "build_message", When: time.Now(), Data: map[string]any{}}
+	}
+	s.hub.register <- newClient(0) // Handled after the events.
+
+	if strings.Contains(log.String(), "Dropping client") {
+		t.Errorf("Disconnected clients were still registered:\n%s", log)
+	}
+}
+
+func TestStoppingTheHubClosesClients(t *testing.T) {
+	_, srv, log, cancel := testServer(t)
+
+	const clients = 10
+	conns := make([]*testClient, clients)
+	for i := range conns {
+		conns[i] = listen(t, srv)
+	}
+
+	cancel()
+
+	var wg sync.WaitGroup
+	for i, c := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if event, ok := c.next(); ok {
+				t.Errorf("Client %d got event %q after the hub stopped", i, event)
+			}
+		}()
+	}
+	wg.Wait()
+	waitFor(t, "the sockets to close", func() bool { return log.Count("Closing socket") == clients })
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// How many events are kept for the status.
+const stateEvents = 20
+
+// BuildStatus is the result of the last build.
+type BuildStatus struct {
+	When     time.Time `json:"when"`
+	Duration string    `json:"duration"`
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type StateEvent struct {
+	When time.Time      `json:"when"`
+	Type string         `json:"type"`
+	Data map[string]any `json:"data"`
+}
+
+// Status is a snapshot of the state, as served by /api/status. PID is 0 when the program is not
+// running.
+type Status struct {
+	PID         int          `json:"pid"`
+	Uptime      string       `json:"uptime"`
+	Paused      bool         `json:"paused"`
+	WatchedDirs int          `json:"watched_dirs"`
+	LastBuild   *BuildStatus `json:"last_build"`
+	Events      []StateEvent `json:"events"`
+}
+
+// StateTracker keeps track of what kjor and the program are doing. It is updated by Process and
+// the main loop, and is safe for concurrent use.
+type StateTracker struct {
+	mu          sync.Mutex
+	pid         int
+	started     time.Time
+	paused      bool
+	lastBuild   *BuildStatus
+	events      []StateEvent
+	watchedDirs func() int
+}
+
+func NewStateTracker() *StateTracker {
+	return &StateTracker{
+		events:      make([]StateEvent, 0, stateEvents),
+		watchedDirs: func() int { return 0 },
+	}
+}
+
+func (s *StateTracker) ProgramStarted(pid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pid = pid
+	s.started = time.Now()
+}
+
+func (s *StateTracker) ProgramStopped() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pid = 0
+}
+
+func (s *StateTracker) BuildFinished(duration time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := &BuildStatus{When: time.Now(), Duration: duration.String(), Result: "ok"}
+	switch {
+	case errors.Is(err, ProcessBuildCancelled):
+		status.Result = "cancelled"
+	case err != nil:
+		status.Result = "failed"
+		status.Error = err.Error()
+	}
+	s.lastBuild = status
+}
+
+func (s *StateTracker) SetPaused(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = paused
+}
+
+func (s *StateTracker) Paused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+// WatchedDirsFrom sets where the number of watched directories is read from.
+func (s *StateTracker) WatchedDirsFrom(count func() int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watchedDirs = count
+}
+
+// Record adds an event to the latest events.
+func (s *StateTracker) Record(eventType string, data map[string]any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.events) == stateEvents {
+		s.events = append(s.events[:0], s.events[1:]...)
+	}
+	// The event is on its way to the browser as well, so the data is copied.
+	copied := make(map[string]any, len(data))
+	for k, v := range data {
+		copied[k] = v
+	}
+	s.events = append(s.events, StateEvent{When: time.Now(), Type: eventType, Data: copied})
+}
+
+func (s *StateTracker) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := Status{
+		PID:         s.pid,
+		Paused:      s.paused,
+		WatchedDirs: s.watchedDirs(),
+		LastBuild:   s.lastBuild,
+		Events:      append(make([]StateEvent, 0, len(s.events)), s.events...),
+	}
+	if s.pid != 0 {
+		status.Uptime = time.Since(s.started).Round(time.Second).String()
+	}
+	return status
+}
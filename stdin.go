@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+type StdinMode string
+
+const (
+	StdinNone    StdinMode = "none"
+	StdinForward StdinMode = "forward"
+)
+
+func UnknownStdinMode(name string) error {
+	return fmt.Errorf("Unknown stdin mode: [%s]", name)
+}
+
+func parseStdinMode(name string) (StdinMode, error) {
+	switch StdinMode(name) {
+	case "", StdinNone:
+		return StdinNone, nil
+	case StdinForward:
+		return StdinForward, nil
+	default:
+		return "", UnknownStdinMode(name)
+	}
+}
+
+// stdinForwarder copies kjor's stdin to the stdin of the program that is currently running.
+// Input arriving while no program is running is dropped.
+type stdinForwarder struct {
+	in      io.Reader
+	mu      sync.Mutex
+	current io.WriteCloser
+	eof     bool
+	once    sync.Once
+	logger  *slog.Logger
+}
+
+func newStdinForwarder(in io.Reader, logger *slog.Logger) *stdinForwarder {
+	return &stdinForwarder{in: in, logger: logger}
+}
+
+// Start begins copying. It only has an effect the first time it is called.
+func (f *stdinForwarder) Start() {
+	f.once.Do(func() { go f.copy() })
+}
+
+// attach makes w the destination of the input. When kjor's stdin has ended, w is closed right
+// away so that the program sees the end of its input too.
+func (f *stdinForwarder) attach(w io.WriteCloser) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.current = w
+	if f.eof {
+		w.Close()
+	}
+}
+
+func (f *stdinForwarder) copy() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := f.in.Read(buf)
+		if n > 0 {
+			f.write(buf[:n])
+		}
+
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				f.logger.Warn("Failed to read stdin", "err", err)
+			}
+
+			f.mu.Lock()
+			f.eof = true
+			if f.current != nil {
+				f.current.Close()
+			}
+			f.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (f *stdinForwarder) write(b []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.current == nil {
+		f.logger.Debug("No program running, dropping input", "bytes", len(b))
+		return
+	}
+
+	// A program that has exited closed its end of the pipe, which is not a problem.
+	if _, err := f.current.Write(b); err != nil {
+		f.logger.Debug("Failed to forward input", "err", err)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type RestartPolicy string
+
+const (
+	RestartNever     RestartPolicy = "never"
+	RestartOnFailure RestartPolicy = "on-failure"
+	RestartAlways    RestartPolicy = "always"
+)
+
+const (
+	defaultMaxRestarts    = 5
+	defaultRestartBackoff = 500
+	maxRestartBackoff     = 30 * time.Second
+	// A program that has been running this long is not considered part of a crash loop.
+	crashLoopReset  = 10 * time.Second
+	stderrTailLines = 20
+)
+
+func UnknownRestartPolicy(name string) error {
+	return fmt.Errorf("Unknown restart policy: [%s]", name)
+}
+
+func parseRestartPolicy(name string) (RestartPolicy, error) {
+	switch RestartPolicy(name) {
+	case "", RestartNever:
+		return RestartNever, nil
+	case RestartOnFailure, RestartAlways:
+		return RestartPolicy(name), nil
+	default:
+		return "", UnknownRestartPolicy(name)
+	}
+}
+
+// programRun is a single execution of the program. done is closed once the supervisor has waited
+// for it, after which err holds the result of cmd.Wait.
+type programRun struct {
+	cmd     *exec.Cmd
+	cancel  context.CancelFunc
+	done    chan struct{}
+	err     error
+	started time.Time
+	// stopped is set when kjor itself asks the program to stop, so the exit is not a crash.
+	stopped atomic.Bool
+}
+
+// exitDescription returns the attributes describing how the program exited.
+func (r *programRun) exitDescription() map[string]any {
+	desc := map[string]any{"pid": r.cmd.Process.Pid}
+	if r.cmd.ProcessState == nil {
+		desc["error"] = fmt.Sprint(r.err)
+		return desc
+	}
+
+	status, ok := r.cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		desc["signal"] = status.Signal().String()
+	} else {
+		desc["code"] = r.cmd.ProcessState.ExitCode()
+	}
+	return desc
+}
+
+func (r *programRun) failed() bool {
+	return r.cmd.ProcessState == nil || !r.cmd.ProcessState.Success()
+}
+
+// tailWriter keeps the last lines written to it.
+type tailWriter struct {
+	mu      sync.Mutex
+	max     int
+	lines   []string
+	partial []byte
+}
+
+func newTailWriter(max int) *tailWriter {
+	return &tailWriter{max: max}
+}
+
+func (tw *tailWriter) Write(out []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	tw.partial = append(tw.partial, out...)
+	for {
+		i := bytes.IndexByte(tw.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		tw.lines = append(tw.lines, string(bytes.TrimRight(tw.partial[:i], "\r")))
+		if len(tw.lines) > tw.max {
+			tw.lines = tw.lines[len(tw.lines)-tw.max:]
+		}
+		tw.partial = tw.partial[i+1:]
+	}
+	return len(out), nil
+}
+
+func (tw *tailWriter) Lines() []string {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	lines := append([]string(nil), tw.lines...)
+	if len(tw.partial) > 0 {
+		lines = append(lines, string(tw.partial))
+	}
+	return lines
+}
+
+func (tw *tailWriter) Reset() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	tw.lines = nil
+	tw.partial = nil
+}
+
+// cancelCrashRestart makes a restart by the supervisor give up, so that the caller does not have to
+// wait for a program that is about to be replaced to get ready.
+func (p *Process) cancelCrashRestart() {
+	p.crashRestartMu.Lock()
+	defer p.crashRestartMu.Unlock()
+
+	if p.crashRestart != nil {
+		p.crashRestart()
+	}
+}
+
+// supervise waits for run to exit. If the exit was not requested by kjor it is reported, and the
+// program is started again if the restart policy says so.
+func (p *Process) supervise(run *programRun) {
+	run.err = run.cmd.Wait()
+	p.state.ProgramStopped()
+	close(run.done)
+
+	// Cancelling the base context means kjor is shutting down.
+	if run.stopped.Load() || p.ctx.Err() != nil {
+		return
+	}
+
+	exit := run.exitDescription()
+	exit["stderr"] = p.stderrTail.Lines()
+	p.processLog.Warn("Program exited", "pid", exit["pid"], "state", run.cmd.ProcessState)
+	p.notify("program_exited", exit)
+
+	if p.restartPolicy == RestartNever || (p.restartPolicy == RestartOnFailure && !run.failed()) {
+		return
+	}
+
+	p.mu.Lock()
+	if p.run != run {
+		p.mu.Unlock()
+		return
+	}
+
+	if time.Since(run.started) > crashLoopReset {
+		p.crashes = 0
+	}
+	p.crashes++
+	if p.crashes > p.maxRestarts {
+		p.processLog.Error("Program keeps crashing, not restarting it until the next change", "restarts", p.maxRestarts)
+		p.mu.Unlock()
+		return
+	}
+
+	attempt := p.crashes
+	backoff := p.restartBackoff << (attempt - 1)
+	if backoff > maxRestartBackoff || backoff <= 0 {
+		backoff = maxRestartBackoff
+	}
+	p.mu.Unlock()
+
+	p.processLog.Info("Restarting program", "in", backoff, "attempt", attempt)
+	select {
+	case <-time.After(backoff):
+	case <-p.ctx.Done():
+		return
+	}
+
+	// Registered before taking the lock, so that a rebuild, restart or stop wanting the lock can
+	// always cancel the wait for the program to get ready.
+	ctx, cancel := context.WithCancel(p.ctx)
+	defer cancel()
+	p.crashRestartMu.Lock()
+	p.crashRestart = cancel
+	p.crashRestartMu.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// A rebuild, restart or stop may have happened, or be waiting, by now.
+	if p.run != run || ctx.Err() != nil {
+		return
+	}
+
+	if err := p.startProgram(ctx); errors.Is(err, ProcessBuildCancelled) {
+		return
+	} else if err != nil {
+		p.processLog.Warn("Failed to restart program", "err", err)
+		p.notify("start_failed", map[string]any{"message": err.Error()})
+		return
+	}
+	p.notify("build_action", map[string]any{"restarted": true, "ready": p.readiness != nil})
+}